@@ -0,0 +1,15 @@
+// Command firetest-helper does the privileged work of a launch for a
+// controller running without root, see package helper. Grant it the
+// capabilities of privilege.Helper with setcap +p, it raises them only
+// around the system calls that need them.
+package main
+
+import (
+	"os"
+
+	"ranjankuldeep/test/helper"
+)
+
+func main() {
+	os.Exit(helper.Main(os.Args[1:]))
+}
@@ -0,0 +1,215 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv4/server4"
+	"github.com/weaveworks/ignite/pkg/logs"
+
+	"ranjankuldeep/test/ipam"
+	"ranjankuldeep/test/netlink"
+	"ranjankuldeep/test/privilege"
+)
+
+// Config is what the server hands to the guest.
+type Config struct {
+	// Lease is the IPv4 lease of the guest.
+	Lease *ipam.Lease
+	// MAC is the guest interface's address, only requests from it are
+	// answered. It defaults to the MAC of the lease.
+	MAC         string
+	Nameservers []string
+	Search      []string
+	// MTU is advertised with the interface MTU option if set.
+	MTU int
+}
+
+// Server answers the DHCPv4 requests of one guest on its tap device.
+type Server struct {
+	nsPath string
+	iface  string
+	cfg    Config
+	server *server4.Server
+	done   chan struct{}
+}
+
+var (
+	mu      sync.Mutex
+	servers = map[string]*Server{}
+)
+
+// Serve starts a DHCPv4 server on iface inside the namespace at nsPath,
+// replacing a server already serving it. The socket is created inside the
+// namespace and bound to iface; the tc redirect of iface must exempt DHCP, see
+// netlink.AddTcLocalDelivery.
+//
+// Replies are broadcast and the lease is infinite. The guest shares its
+// address with the sandbox, so a unicast reply would be delivered locally, and
+// unicast renewals never reach the server. IPAM pins the address for the life
+// of the VM anyway.
+func Serve(nsPath string, iface string, cfg Config) error {
+	if cfg.Lease == nil || cfg.Lease.IsIPv6() {
+		return fmt.Errorf("DHCP server for %s needs an IPv4 lease", iface)
+	}
+	if cfg.MAC == "" {
+		cfg.MAC = cfg.Lease.MAC
+	}
+	mac, err := net.ParseMAC(cfg.MAC)
+	if err != nil {
+		return fmt.Errorf("invalid MAC of DHCP client on %s: %w", iface, err)
+	}
+	// compare in the form ClientHWAddr prints in
+	cfg.MAC = mac.String()
+	if err := Stop(nsPath, iface); err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	if err := netlink.WithNetNSByPath(nsPath, func() error {
+		if err := allowServerPort(); err != nil {
+			return err
+		}
+		var err error
+		conn, err = server4.NewIPv4UDPConn(iface, &net.UDPAddr{Port: dhcpv4.ServerPort})
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to open DHCP socket on %s: %w", iface, err)
+	}
+
+	s := &Server{nsPath: nsPath, iface: iface, cfg: cfg, done: make(chan struct{})}
+	server, err := server4.NewServer(iface, nil, s.handle, server4.WithConn(conn))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.server = server
+	go func() {
+		defer close(s.done)
+		if err := server.Serve(); err != nil && !errors.Is(err, net.ErrClosed) {
+			logs.Logger.Errorf("DHCP server on %s stopped: %v", iface, err)
+		}
+	}()
+
+	mu.Lock()
+	servers[key(nsPath, iface)] = s
+	mu.Unlock()
+	logs.Logger.Infof("Serving DHCP for %s on %s", cfg.Lease.IP.String(), iface)
+	return nil
+}
+
+// Stop stops the server of iface. Stopping a server that is not running is not
+// an error.
+func Stop(nsPath string, iface string) error {
+	mu.Lock()
+	s, ok := servers[key(nsPath, iface)]
+	delete(servers, key(nsPath, iface))
+	mu.Unlock()
+	if !ok {
+		return nil
+	}
+	err := s.server.Close()
+	<-s.done
+	return err
+}
+
+func key(nsPath string, iface string) string {
+	return nsPath + "/" + iface
+}
+
+func (s *Server) handle(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	if req.OpCode != dhcpv4.OpcodeBootRequest || req.ClientHWAddr.String() != s.cfg.MAC {
+		return
+	}
+	ip := s.cfg.Lease.IP.IP.To4()
+
+	var reply dhcpv4.MessageType
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		reply = dhcpv4.MessageTypeOffer
+	case dhcpv4.MessageTypeRequest:
+		reply = dhcpv4.MessageTypeAck
+		requested := req.RequestedIPAddress()
+		if requested == nil {
+			requested = req.ClientIPAddr
+		}
+		if !requested.Equal(ip) {
+			reply = dhcpv4.MessageTypeNak
+		}
+	default:
+		return
+	}
+
+	modifiers := []dhcpv4.Modifier{
+		dhcpv4.WithMessageType(reply),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(s.cfg.Lease.Gateway)),
+	}
+	if reply != dhcpv4.MessageTypeNak {
+		modifiers = append(modifiers,
+			dhcpv4.WithYourIP(ip),
+			dhcpv4.WithNetmask(s.cfg.Lease.IP.Mask),
+			dhcpv4.WithRouter(s.cfg.Lease.Gateway),
+			dhcpv4.WithLeaseTime(uint32(dhcpv4.MaxLeaseTime.Seconds())),
+		)
+		if dns := s.nameservers(); len(dns) > 0 {
+			modifiers = append(modifiers, dhcpv4.WithDNS(dns...))
+		}
+		if len(s.cfg.Search) > 0 {
+			modifiers = append(modifiers, dhcpv4.WithDomainSearchList(s.cfg.Search...))
+		}
+		if s.cfg.MTU != 0 {
+			mtu := make([]byte, 2)
+			binary.BigEndian.PutUint16(mtu, uint16(s.cfg.MTU))
+			modifiers = append(modifiers, dhcpv4.WithGeneric(dhcpv4.OptionInterfaceMTU, mtu))
+		}
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req, modifiers...)
+	if err != nil {
+		logs.Logger.Errorf("Failed to build DHCP %s for %s: %v", reply, req.ClientHWAddr, err)
+		return
+	}
+	bcast := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpv4.ClientPort}
+	if _, err := conn.WriteTo(resp.ToBytes(), bcast); err != nil {
+		logs.Logger.Errorf("Failed to send DHCP %s on %s: %v", reply, s.iface, err)
+		return
+	}
+	logs.Logger.Infof("Sent DHCP %s of %s to %s", reply, ip, req.ClientHWAddr)
+}
+
+func (s *Server) nameservers() []net.IP {
+	var dns []net.IP
+	for _, ns := range s.cfg.Nameservers {
+		if ip := net.ParseIP(ns).To4(); ip != nil {
+			dns = append(dns, ip)
+		}
+	}
+	return dns
+}
+
+// allowServerPort lets the DHCP server bind its port in the sandbox without
+// CAP_NET_BIND_SERVICE, which the controller does not hold, by lowering the
+// namespace's first privileged port. It must run inside the namespace.
+func allowServerPort() error {
+	if privilege.Require("binding the DHCP server port", privilege.CapNetBindService) == nil {
+		return nil
+	}
+	const sysctl = "/proc/sys/net/ipv4/ip_unprivileged_port_start"
+	data, err := os.ReadFile(sysctl)
+	if err != nil {
+		return err
+	}
+	if start, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && start <= dhcpv4.ServerPort {
+		return nil
+	}
+	if err := os.WriteFile(sysctl, []byte(strconv.Itoa(dhcpv4.ServerPort)), 0644); err != nil {
+		return fmt.Errorf("failed to allow binding port %d: %w", dhcpv4.ServerPort, err)
+	}
+	return nil
+}
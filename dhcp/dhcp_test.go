@@ -0,0 +1,150 @@
+package dhcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+
+	"ranjankuldeep/test/ipam"
+)
+
+// recorder is a PacketConn keeping the packets written to it.
+type recorder struct {
+	net.PacketConn
+	packets [][]byte
+	addrs   []net.Addr
+}
+
+func (r *recorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	r.packets = append(r.packets, append([]byte(nil), b...))
+	r.addrs = append(r.addrs, addr)
+	return len(b), nil
+}
+
+var guestMAC = net.HardwareAddr{0x02, 0xfc, 0, 0, 0, 1}
+
+func testServer() *Server {
+	return &Server{iface: "tap0", cfg: Config{
+		Lease: &ipam.Lease{
+			IP:      net.IPNet{IP: net.ParseIP("172.16.0.2").To4(), Mask: net.CIDRMask(24, 32)},
+			Gateway: net.ParseIP("172.16.0.1").To4(),
+		},
+		MAC:         guestMAC.String(),
+		Nameservers: []string{"8.8.8.8", "2001:4860:4860::8888"},
+		Search:      []string{"example.com"},
+		MTU:         1450,
+	}}
+}
+
+// reply runs req through the server and returns its only reply, or nil.
+func reply(t *testing.T, s *Server, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+	conn := &recorder{}
+	s.handle(conn, nil, req)
+	switch len(conn.packets) {
+	case 0:
+		return nil
+	case 1:
+	default:
+		t.Fatalf("server sent %d replies", len(conn.packets))
+	}
+	if addr := conn.addrs[0].(*net.UDPAddr); !addr.IP.Equal(net.IPv4bcast) || addr.Port != dhcpv4.ClientPort {
+		t.Errorf("reply sent to %s, want broadcast to the client port", addr)
+	}
+	resp, err := dhcpv4.FromBytes(conn.packets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHandleDiscover(t *testing.T) {
+	s := testServer()
+	req, err := dhcpv4.NewDiscovery(guestMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := reply(t, s, req)
+	if resp == nil {
+		t.Fatal("no offer")
+	}
+	if resp.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Errorf("reply is a %s, want an offer", resp.MessageType())
+	}
+	if !resp.YourIPAddr.Equal(s.cfg.Lease.IP.IP) {
+		t.Errorf("offered %s, want %s", resp.YourIPAddr, s.cfg.Lease.IP.IP)
+	}
+	if got := net.IPMask(resp.SubnetMask()); got.String() != s.cfg.Lease.IP.Mask.String() {
+		t.Errorf("netmask %s, want %s", got, s.cfg.Lease.IP.Mask)
+	}
+	if routers := resp.Router(); len(routers) != 1 || !routers[0].Equal(s.cfg.Lease.Gateway) {
+		t.Errorf("routers %v, want %s", routers, s.cfg.Lease.Gateway)
+	}
+	if id := resp.ServerIdentifier(); !id.Equal(s.cfg.Lease.Gateway) {
+		t.Errorf("server identifier %s, want %s", id, s.cfg.Lease.Gateway)
+	}
+	if dns := resp.DNS(); len(dns) != 1 || !dns[0].Equal(net.ParseIP("8.8.8.8")) {
+		t.Errorf("DNS %v, want only the IPv4 nameserver", dns)
+	}
+	if search := resp.DomainSearch(); search == nil || len(search.Labels) != 1 || search.Labels[0] != "example.com" {
+		t.Errorf("search list %v, want example.com", search)
+	}
+	if mtu := resp.Options.Get(dhcpv4.OptionInterfaceMTU); len(mtu) != 2 || binary.BigEndian.Uint16(mtu) != 1450 {
+		t.Errorf("interface MTU option %v, want 1450", mtu)
+	}
+	if lease := resp.IPAddressLeaseTime(0); lease != dhcpv4.MaxLeaseTime {
+		t.Errorf("lease time %v, want infinite", lease)
+	}
+}
+
+func TestHandleRequest(t *testing.T) {
+	s := testServer()
+	tests := []struct {
+		name      string
+		requested net.IP
+		want      dhcpv4.MessageType
+	}{
+		{"leased address", s.cfg.Lease.IP.IP, dhcpv4.MessageTypeAck},
+		{"other address", net.ParseIP("172.16.0.3").To4(), dhcpv4.MessageTypeNak},
+	}
+	for _, tt := range tests {
+		req, err := dhcpv4.New(
+			dhcpv4.WithHwAddr(guestMAC),
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(tt.requested)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := reply(t, s, req)
+		if resp == nil {
+			t.Errorf("%s: no reply", tt.name)
+			continue
+		}
+		if resp.MessageType() != tt.want {
+			t.Errorf("%s: reply is a %s, want %s", tt.name, resp.MessageType(), tt.want)
+		}
+		if tt.want == dhcpv4.MessageTypeNak && !resp.YourIPAddr.IsUnspecified() {
+			t.Errorf("%s: NAK offers %s", tt.name, resp.YourIPAddr)
+		}
+	}
+}
+
+func TestHandleIgnores(t *testing.T) {
+	s := testServer()
+	other, err := dhcpv4.NewDiscovery(net.HardwareAddr{0x02, 0xfc, 0, 0, 0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, err := dhcpv4.New(dhcpv4.WithHwAddr(guestMAC), dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, req := range map[string]*dhcpv4.DHCPv4{"other client": other, "release": release} {
+		if resp := reply(t, s, req); resp != nil {
+			t.Errorf("%s: server replied with a %s", name, resp.MessageType())
+		}
+	}
+}
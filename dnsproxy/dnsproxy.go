@@ -0,0 +1,241 @@
+package dnsproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/helper"
+	"ranjankuldeep/test/netlink"
+)
+
+// Config is the DNS policy of one guest interface.
+type Config struct {
+	// Upstreams are the resolvers allowed queries are forwarded to, as "ip"
+	// or "ip:port". At least one is required, the server the guest asked is
+	// never contacted as the queries leave from the host namespace.
+	Upstreams []string
+	// Allow restricts the resolvable names to these domains and their
+	// subdomains. Every name resolves if empty, other queries are refused.
+	Allow []string
+}
+
+// maxInFlight bounds the queries of a guest resolved at once, further
+// queries are dropped and retried by the guest's resolver.
+const maxInFlight = 32
+
+// Proxy answers the UDP DNS queries a guest sends through its tap.
+type Proxy struct {
+	iface    string
+	cfg      Config
+	file     *os.File
+	client   *dns.Client
+	inFlight chan struct{}
+	done     chan struct{}
+}
+
+var (
+	mu      sync.Mutex
+	proxies = map[string]*Proxy{}
+)
+
+// Start intercepts the DNS queries arriving on iface inside the namespace at
+// nsPath, replacing a proxy already running on it. Queries are logged, names
+// outside the allow list are refused and the others are resolved by the
+// upstreams and answered as if by the server the guest queried.
+//
+// The guest shares its address with the sandbox, so no socket in the
+// namespace can talk to it. The proxy captures the queries with a packet
+// socket on iface and writes the answers back as frames; it reaches the
+// upstreams from the host namespace, as everything arriving on the sandbox
+// uplink is redirected to the guest. The tc redirect of iface must exempt UDP
+// port 53 (netlink.AddTcLocalDelivery) for the sandbox to drop the original
+// query. TCP queries are not answered, exempt TCP port 53 as well to keep
+// them from bypassing the allow list.
+func Start(nsPath string, iface string, cfg Config) error {
+	if len(cfg.Upstreams) == 0 {
+		return fmt.Errorf("DNS proxy on %s has no upstreams", iface)
+	}
+	if err := Stop(nsPath, iface); err != nil {
+		return err
+	}
+
+	// the socket comes from the privileged helper, this process lacks
+	// CAP_NET_RAW
+	fd, err := helper.PacketSocket(nsPath)
+	if err != nil {
+		return fmt.Errorf("failed to capture DNS queries on %s: %w", iface, err)
+	}
+	file := os.NewFile(uintptr(fd), "packet:"+iface)
+	if err := netlink.WithNetNSByPath(nsPath, func() error {
+		return setUpPacketSocket(fd, iface)
+	}); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to capture DNS queries on %s: %w", iface, err)
+	}
+
+	p := &Proxy{
+		iface:    iface,
+		cfg:      cfg,
+		file:     file,
+		client:   &dns.Client{Net: "udp", Timeout: 5 * time.Second},
+		inFlight: make(chan struct{}, maxInFlight),
+		done:     make(chan struct{}),
+	}
+	go p.serve()
+
+	mu.Lock()
+	proxies[key(nsPath, iface)] = p
+	mu.Unlock()
+	logs.Logger.Infof("Proxying DNS queries on %s", iface)
+	return nil
+}
+
+// Stop stops the proxy of iface. Stopping a proxy that is not running is not
+// an error.
+func Stop(nsPath string, iface string) error {
+	mu.Lock()
+	p, ok := proxies[key(nsPath, iface)]
+	delete(proxies, key(nsPath, iface))
+	mu.Unlock()
+	if !ok {
+		return nil
+	}
+	err := p.file.Close()
+	<-p.done
+	return err
+}
+
+func key(nsPath string, iface string) string {
+	return nsPath + "/" + iface
+}
+
+// setUpPacketSocket makes the packet socket fd capture the UDP port 53
+// traffic arriving on iface. It must run inside the namespace of iface.
+func setUpPacketSocket(fd int, iface string) error {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	raw, err := bpf.Assemble(queryFilter)
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(raw))
+	for i, insn := range raw {
+		filter[i] = unix.SockFilter{Code: insn.Op, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+		return fmt.Errorf("failed to attach filter: %w", err)
+	}
+	// our own answers leave through iface as well
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_IGNORE_OUTGOING, 1); err != nil {
+		return fmt.Errorf("failed to ignore outgoing packets: %w", err)
+	}
+	return unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: link.Index})
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+func (p *Proxy) serve() {
+	defer close(p.done)
+	buf := make([]byte, 65536)
+	for {
+		n, err := p.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				logs.Logger.Errorf("DNS proxy on %s stopped: %v", p.iface, err)
+			}
+			return
+		}
+		d, ok := parseDatagram(append([]byte(nil), buf[:n]...))
+		if !ok || d.dport != 53 {
+			continue
+		}
+		select {
+		case p.inFlight <- struct{}{}:
+			go func() {
+				defer func() { <-p.inFlight }()
+				p.handle(d)
+			}()
+		default:
+			logs.Logger.Debugf("DNS %s: %d queries in flight, dropping query from %s", p.iface, maxInFlight, d.src)
+		}
+	}
+}
+
+func (p *Proxy) handle(d *datagram) {
+	query := new(dns.Msg)
+	if err := query.Unpack(d.payload); err != nil || len(query.Question) == 0 {
+		return
+	}
+	q := query.Question[0]
+	qtype := dns.TypeToString[q.Qtype]
+
+	var resp *dns.Msg
+	if !p.cfg.allowed(q.Name) {
+		logs.Logger.Infof("DNS %s %s %s from %s refused", p.iface, qtype, q.Name, d.src)
+		resp = new(dns.Msg).SetRcode(query, dns.RcodeRefused)
+	} else {
+		var err error
+		resp, err = p.forward(query)
+		if err != nil {
+			logs.Logger.Errorf("DNS %s %s %s from %s failed: %v", p.iface, qtype, q.Name, d.src, err)
+			resp = new(dns.Msg).SetRcode(query, dns.RcodeServerFailure)
+		} else {
+			logs.Logger.Infof("DNS %s %s %s from %s: %s", p.iface, qtype, q.Name, d.src, dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	size := dns.MinMsgSize
+	if opt := query.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	resp.Truncate(size)
+	payload, err := resp.Pack()
+	if err != nil {
+		logs.Logger.Errorf("Failed to pack DNS answer for %s: %v", q.Name, err)
+		return
+	}
+	if _, err := p.file.Write(d.reply(payload)); err != nil {
+		logs.Logger.Errorf("Failed to answer DNS query on %s: %v", p.iface, err)
+	}
+}
+
+func (p *Proxy) forward(query *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, upstream := range p.cfg.Upstreams {
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			upstream = net.JoinHostPort(upstream, "53")
+		}
+		resp, _, err := p.client.Exchange(query, upstream)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (c Config) allowed(name string) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, domain := range c.Allow {
+		if dns.IsSubDomain(dns.Fqdn(domain), name) {
+			return true
+		}
+	}
+	return false
+}
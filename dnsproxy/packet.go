@@ -0,0 +1,165 @@
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"net"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// queryFilter only passes UDP datagrams to port 53, so the rest of the
+// guest's traffic is never copied to the proxy.
+var queryFilter = []bpf.Instruction{
+	/* 0 */ bpf.LoadAbsolute{Off: 12, Size: 2},
+	/* 1 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.ETH_P_IP, SkipFalse: 5},
+	/* 2 */ bpf.LoadAbsolute{Off: 23, Size: 1},
+	/* 3 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: 9},
+	/* 4 */ bpf.LoadMemShift{Off: 14},
+	/* 5 */ bpf.LoadIndirect{Off: 16, Size: 2},
+	/* 6 */ bpf.Jump{Skip: 4},
+	/* 7 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.ETH_P_IPV6, SkipFalse: 5},
+	/* 8 */ bpf.LoadAbsolute{Off: 20, Size: 1},
+	/* 9 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.IPPROTO_UDP, SkipFalse: 3},
+	/* 10 */ bpf.LoadAbsolute{Off: 56, Size: 2},
+	/* 11 */ bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipFalse: 1},
+	/* 12 */ bpf.RetConstant{Val: 0x40000},
+	/* 13 */ bpf.RetConstant{Val: 0},
+}
+
+const (
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+)
+
+// datagram is a UDP query of the guest as captured on its tap.
+type datagram struct {
+	srcMAC, dstMAC net.HardwareAddr
+	src, dst       net.IP
+	sport, dport   uint16
+	payload        []byte
+}
+
+func (d *datagram) isIPv6() bool {
+	return d.src.To4() == nil
+}
+
+// parseDatagram decodes an Ethernet frame carrying a UDP datagram over IPv4
+// or IPv6 without extension headers.
+func parseDatagram(frame []byte) (*datagram, bool) {
+	if len(frame) < ethHeaderLen {
+		return nil, false
+	}
+	d := &datagram{
+		dstMAC: net.HardwareAddr(frame[0:6]),
+		srcMAC: net.HardwareAddr(frame[6:12]),
+	}
+	var udp []byte
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case unix.ETH_P_IP:
+		ip := frame[ethHeaderLen:]
+		if len(ip) < ipv4HeaderLen || ip[9] != unix.IPPROTO_UDP {
+			return nil, false
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if ihl < ipv4HeaderLen || total > len(ip) || total < ihl+udpHeaderLen {
+			return nil, false
+		}
+		d.src, d.dst = net.IP(ip[12:16]), net.IP(ip[16:20])
+		udp = ip[ihl:total]
+	case unix.ETH_P_IPV6:
+		ip := frame[ethHeaderLen:]
+		if len(ip) < ipv6HeaderLen || ip[6] != unix.IPPROTO_UDP {
+			return nil, false
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(ip[4:6]))
+		if total > len(ip) || total < ipv6HeaderLen+udpHeaderLen {
+			return nil, false
+		}
+		d.src, d.dst = net.IP(ip[8:24]), net.IP(ip[24:40])
+		udp = ip[ipv6HeaderLen:total]
+	default:
+		return nil, false
+	}
+	d.sport = binary.BigEndian.Uint16(udp[0:2])
+	d.dport = binary.BigEndian.Uint16(udp[2:4])
+	d.payload = udp[udpHeaderLen:]
+	return d, true
+}
+
+// reply builds the frame answering d with payload, as if it came from the
+// server the guest queried.
+func (d *datagram) reply(payload []byte) []byte {
+	udpLen := udpHeaderLen + len(payload)
+	ipLen := ipv4HeaderLen
+	etherType := uint16(unix.ETH_P_IP)
+	if d.isIPv6() {
+		ipLen = ipv6HeaderLen
+		etherType = unix.ETH_P_IPV6
+	}
+	frame := make([]byte, ethHeaderLen+ipLen+udpLen)
+	copy(frame[0:6], d.srcMAC)
+	copy(frame[6:12], d.dstMAC)
+	binary.BigEndian.PutUint16(frame[12:14], etherType)
+
+	ip := frame[ethHeaderLen : ethHeaderLen+ipLen]
+	src, dst := d.dst, d.src
+	if d.isIPv6() {
+		ip[0] = 6 << 4
+		binary.BigEndian.PutUint16(ip[4:6], uint16(udpLen))
+		ip[6] = unix.IPPROTO_UDP
+		ip[7] = 64
+		copy(ip[8:24], src.To16())
+		copy(ip[24:40], dst.To16())
+	} else {
+		ip[0] = 4<<4 | ipv4HeaderLen/4
+		binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen+udpLen))
+		ip[8] = 64
+		ip[9] = unix.IPPROTO_UDP
+		copy(ip[12:16], src.To4())
+		copy(ip[16:20], dst.To4())
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip, 0))
+	}
+
+	udp := frame[ethHeaderLen+ipLen:]
+	binary.BigEndian.PutUint16(udp[0:2], d.dport)
+	binary.BigEndian.PutUint16(udp[2:4], d.sport)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[udpHeaderLen:], payload)
+	sum := checksum(udp, pseudoHeaderSum(src, dst, udpLen))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], sum)
+	return frame
+}
+
+func pseudoHeaderSum(src, dst net.IP, udpLen int) uint32 {
+	var sum uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		src, dst = src4, dst4
+	}
+	for _, addr := range [][]byte{src, dst} {
+		for i := 0; i < len(addr); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(addr[i:]))
+		}
+	}
+	return sum + unix.IPPROTO_UDP + uint32(udpLen)
+}
+
+// checksum is the internet checksum of b, starting from sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
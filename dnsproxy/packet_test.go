@@ -0,0 +1,135 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+var (
+	guestMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	gwMAC    = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+// query is the frame of a guest query from src:5353 to dst:dport, built as
+// the reply of the opposite direction.
+func query(src, dst net.IP, dport uint16, payload []byte) []byte {
+	d := &datagram{srcMAC: gwMAC, dstMAC: guestMAC, src: dst, dst: src, sport: dport, dport: 5353}
+	return d.reply(payload)
+}
+
+func TestParseDatagram(t *testing.T) {
+	payload := []byte("query")
+	tests := []struct {
+		name     string
+		src, dst net.IP
+	}{
+		{"IPv4", net.ParseIP("10.0.0.2").To4(), net.ParseIP("1.1.1.1").To4()},
+		{"IPv6", net.ParseIP("fd00::2"), net.ParseIP("2606:4700::1111")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := parseDatagram(query(tt.src, tt.dst, 53, payload))
+			if !ok {
+				t.Fatal("parseDatagram() failed")
+			}
+			if !d.src.Equal(tt.src) || !d.dst.Equal(tt.dst) || d.sport != 5353 || d.dport != 53 {
+				t.Errorf("parsed %s:%d -> %s:%d", d.src, d.sport, d.dst, d.dport)
+			}
+			if !bytes.Equal(d.srcMAC, guestMAC) || !bytes.Equal(d.dstMAC, gwMAC) {
+				t.Errorf("parsed %s -> %s", d.srcMAC, d.dstMAC)
+			}
+			if !bytes.Equal(d.payload, payload) {
+				t.Errorf("payload = %q, want %q", d.payload, payload)
+			}
+			if d.isIPv6() != (tt.src.To4() == nil) {
+				t.Errorf("isIPv6() = %v", d.isIPv6())
+			}
+		})
+	}
+}
+
+func TestParseDatagramRejects(t *testing.T) {
+	valid := query(net.ParseIP("10.0.0.2").To4(), net.ParseIP("1.1.1.1").To4(), 53, []byte("query"))
+	modify := func(fn func(frame []byte) []byte) []byte {
+		return fn(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"empty", nil},
+		{"truncated ethernet", valid[:10]},
+		{"truncated IP header", valid[:ethHeaderLen+10]},
+		{"truncated datagram", valid[:len(valid)-2]},
+		{"ARP", modify(func(f []byte) []byte { binary.BigEndian.PutUint16(f[12:14], 0x0806); return f })},
+		{"TCP", modify(func(f []byte) []byte { f[ethHeaderLen+9] = 6; return f })},
+		{"short IHL", modify(func(f []byte) []byte { f[ethHeaderLen] = 0x44; return f })},
+	}
+	for _, tt := range tests {
+		if _, ok := parseDatagram(tt.frame); ok {
+			t.Errorf("%s: parseDatagram() succeeded", tt.name)
+		}
+	}
+}
+
+func TestReplyChecksums(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.IP
+		ipLen    int
+	}{
+		{"IPv4", net.ParseIP("10.0.0.2").To4(), net.ParseIP("1.1.1.1").To4(), ipv4HeaderLen},
+		{"IPv6", net.ParseIP("fd00::2"), net.ParseIP("2606:4700::1111"), ipv6HeaderLen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// odd length, to cover the padding of the checksum
+			frame := query(tt.src, tt.dst, 53, []byte("answer!"))
+			ip := frame[ethHeaderLen : ethHeaderLen+tt.ipLen]
+			if tt.ipLen == ipv4HeaderLen && checksum(ip, 0) != 0 {
+				t.Error("invalid IPv4 header checksum")
+			}
+			udp := frame[ethHeaderLen+tt.ipLen:]
+			if sum := checksum(udp, pseudoHeaderSum(tt.dst, tt.src, len(udp))); sum != 0 {
+				t.Errorf("invalid UDP checksum, verification yields %#x", sum)
+			}
+		})
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	vm, err := bpf.NewVM(queryFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4src, v4dst := net.ParseIP("10.0.0.2").To4(), net.ParseIP("1.1.1.1").To4()
+	v6src, v6dst := net.ParseIP("fd00::2"), net.ParseIP("2606:4700::1111")
+	tcp := query(v4src, v4dst, 53, []byte("query"))
+	tcp[ethHeaderLen+9] = 6
+
+	tests := []struct {
+		name  string
+		frame []byte
+		pass  bool
+	}{
+		{"IPv4 DNS", query(v4src, v4dst, 53, []byte("query")), true},
+		{"IPv6 DNS", query(v6src, v6dst, 53, []byte("query")), true},
+		{"IPv4 other port", query(v4src, v4dst, 443, []byte("data")), false},
+		{"IPv6 other port", query(v6src, v6dst, 123, []byte("data")), false},
+		{"TCP", tcp, false},
+	}
+	for _, tt := range tests {
+		n, err := vm.Run(tt.frame)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if (n > 0) != tt.pass {
+			t.Errorf("%s: filter returned %d, want pass %v", tt.name, n, tt.pass)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/netlink"
+)
+
+// MetadataRanges are the cloud instance metadata endpoints a guest must not
+// reach through the host.
+var MetadataRanges = []string{
+	"169.254.0.0/16",
+	"100.100.100.200/32",
+	"fd00:ec2::254/128",
+}
+
+// Rule allows guest traffic to a destination network, optionally restricted
+// to a protocol and destination port.
+type Rule struct {
+	CIDR string
+	// Protocol is "tcp", "udp" or empty for any protocol.
+	Protocol string
+	// Port requires Protocol, zero matches any port.
+	Port uint16
+}
+
+// Policy is the egress policy of one VM interface. Block always wins over
+// Allow. With no Allow rules and DNSOnly unset every destination that is not
+// blocked is reachable.
+type Policy struct {
+	Allow         []Rule
+	Block         []string
+	BlockMetadata bool
+	// DNSOnly restricts the guest to DNS queries, to Resolvers if set.
+	DNSOnly   bool
+	Resolvers []string
+	// Local is accepted into the sandbox namespace instead of forwarded, for
+	// services running there such as the guest's DHCP server.
+	Local []Rule
+}
+
+// Apply programs the policy for the guest behind tapIface in the sandbox
+// namespace at nsPath, replacing any policy applied before.
+//
+// The tc redirect steals packets before netfilter sees them, so the tap must
+// only be redirected in the uplink to tap direction (AddTcRedirectFrom). The
+// netdev ingress chain on the tap then forwards accepted packets to uplinkIface
+// itself. The nftables library has no fwd expression, so packets are dup'ed to
+// the uplink and the original is dropped, which is what fwd does.
+func Apply(nsPath string, tapIface string, uplinkIface string, p Policy) error {
+	// the namespace and uplink lookups classify their errors, so a missing
+	// namespace or uplink matches netlink.ErrNamespaceNotFound and
+	// netlink.ErrLinkNotFound. The nftables socket is opened on the thread
+	// WithNetNSByPath switched into the namespace and raised the
+	// capabilities of.
+	if err := netlink.WithNetNSByPath(nsPath, func() error {
+		uplink, err := netlink.DefaultNetlinkOps().GetLink(uplinkIface)
+		if err != nil {
+			return fmt.Errorf("failed to find uplink %s: %w", uplinkIface, err)
+		}
+		rules, err := p.build(uplink.Attrs().Index)
+		if err != nil {
+			return err
+		}
+
+		conn, err := nftables.New()
+		if err != nil {
+			return err
+		}
+		if err := delTable(conn, tableName(tapIface)); err != nil {
+			return err
+		}
+
+		table := conn.AddTable(&nftables.Table{
+			Family: nftables.TableFamilyNetdev,
+			Name:   tableName(tapIface),
+		})
+		policy := nftables.ChainPolicyDrop
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     "egress",
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookIngress,
+			Priority: nftables.ChainPriorityFilter,
+			Device:   tapIface,
+			Policy:   &policy,
+		})
+		for _, exprs := range rules {
+			conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+		}
+		return conn.Flush()
+	}); err != nil {
+		return fmt.Errorf("failed to program firewall for %s: %w", tapIface, err)
+	}
+	logs.Logger.Infof("Applied egress firewall to %s in %s", tapIface, nsPath)
+	return nil
+}
+
+// Remove deletes the policy of tapIface. Removing a policy that was never
+// applied is not an error.
+func Remove(nsPath string, tapIface string) error {
+	if err := netlink.WithNetNSByPath(nsPath, func() error {
+		conn, err := nftables.New()
+		if err != nil {
+			return err
+		}
+		if err := delTable(conn, tableName(tapIface)); err != nil {
+			return err
+		}
+		return conn.Flush()
+	}); err != nil {
+		return fmt.Errorf("failed to remove firewall of %s: %w", tapIface, err)
+	}
+	return nil
+}
+
+func tableName(tapIface string) string {
+	return "firetest-" + tapIface
+}
+
+func delTable(conn *nftables.Conn, name string) error {
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyNetdev)
+	if err != nil {
+		return fmt.Errorf("failed to list nftables tables: %w", err)
+	}
+	for _, t := range tables {
+		if t.Name == name {
+			conn.DelTable(t)
+		}
+	}
+	return nil
+}
+
+// build translates the policy into rule expressions, in evaluation order.
+func (p Policy) build(uplinkIndex int) ([][]expr.Any, error) {
+	// ARP and IPv6 neighbor discovery have to pass for the guest to resolve
+	// its gateway
+	rules := [][]expr.Any{
+		join(matchEtherType(unix.ETH_P_ARP), forward(uplinkIndex)),
+	}
+	for _, icmpType := range []byte{133, 134, 135, 136} {
+		rules = append(rules, join(matchEtherType(unix.ETH_P_IPV6), []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{icmpType}},
+		}, forward(uplinkIndex)))
+	}
+
+	for _, rule := range p.Local {
+		r, err := rule.match()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, join(r, accept()))
+	}
+
+	blocked := p.Block
+	if p.BlockMetadata {
+		blocked = append(append([]string{}, blocked...), MetadataRanges...)
+	}
+	for _, cidr := range blocked {
+		dst, err := matchDestination(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, join(dst, drop()))
+	}
+
+	if p.DNSOnly {
+		resolvers := p.Resolvers
+		if len(resolvers) == 0 {
+			resolvers = []string{"0.0.0.0/0", "::/0"}
+		}
+		for _, resolver := range resolvers {
+			if ip := net.ParseIP(resolver); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					bits = 32
+				}
+				resolver = fmt.Sprintf("%s/%d", ip, bits)
+			}
+			for _, proto := range []string{"udp", "tcp"} {
+				r, err := Rule{CIDR: resolver, Protocol: proto, Port: 53}.match()
+				if err != nil {
+					return nil, err
+				}
+				rules = append(rules, join(r, forward(uplinkIndex)))
+			}
+		}
+		return rules, nil
+	}
+
+	allow := p.Allow
+	if len(allow) == 0 {
+		allow = []Rule{{CIDR: "0.0.0.0/0"}, {CIDR: "::/0"}}
+	}
+	for _, rule := range allow {
+		r, err := rule.match()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, join(r, forward(uplinkIndex)))
+	}
+	return rules, nil
+}
+
+func (r Rule) match() ([]expr.Any, error) {
+	exprs, err := matchDestination(r.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	if r.Protocol == "" {
+		if r.Port != 0 {
+			return nil, fmt.Errorf("rule for %s sets a port without a protocol", r.CIDR)
+		}
+		return exprs, nil
+	}
+	var proto byte
+	switch r.Protocol {
+	case "tcp":
+		proto = unix.IPPROTO_TCP
+	case "udp":
+		proto = unix.IPPROTO_UDP
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q in rule for %s", r.Protocol, r.CIDR)
+	}
+	exprs = append(exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	)
+	if r.Port != 0 {
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(r.Port)},
+		)
+	}
+	return exprs, nil
+}
+
+// meta protocol ip ip daddr $CIDR
+// or
+// meta protocol ip6 ip6 daddr $CIDR
+func matchDestination(cidr string) ([]expr.Any, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+	}
+	etherType, offset, ip := uint16(unix.ETH_P_IPV6), uint32(24), ipNet.IP.To16()
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		etherType, offset, ip = unix.ETH_P_IP, 16, ip4
+	}
+	size := uint32(len(ip))
+	return join(matchEtherType(etherType), []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: size, Mask: ipNet.Mask, Xor: make([]byte, size)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+	}), nil
+}
+
+func matchEtherType(etherType uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(etherType)},
+	}
+}
+
+// counter dup to $UPLINK drop
+func forward(ifindex int) []expr.Any {
+	return []expr.Any{
+		&expr.Counter{},
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(ifindex))},
+		&expr.Dup{RegDev: 1, IsRegDevSet: true},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
+
+func accept() []expr.Any {
+	return []expr.Any{
+		&expr.Counter{},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}
+}
+
+func drop() []expr.Any {
+	return []expr.Any{
+		&expr.Counter{},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	}
+}
+
+func join(parts ...[]expr.Any) []expr.Any {
+	var exprs []expr.Any
+	for _, part := range parts {
+		exprs = append(exprs, part...)
+	}
+	return exprs
+}
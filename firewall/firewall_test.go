@@ -0,0 +1,126 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables/expr"
+
+	"ranjankuldeep/test/netlink"
+)
+
+// describe summarises a rule as its verdict and, if it matches one, the
+// destination network.
+func describe(rule []expr.Any) string {
+	verdict := "accept"
+	var dst string
+	var mask net.IPMask
+	for _, e := range rule {
+		switch e := e.(type) {
+		case *expr.Bitwise:
+			mask = e.Mask
+		case *expr.Cmp:
+			if mask != nil {
+				dst = (&net.IPNet{IP: e.Data, Mask: mask}).String()
+				mask = nil
+			}
+		case *expr.Dup:
+			verdict = "forward"
+		case *expr.Verdict:
+			if e.Kind == expr.VerdictDrop && verdict != "forward" {
+				verdict = "drop"
+			}
+		}
+	}
+	if dst == "" {
+		return verdict
+	}
+	return verdict + " " + dst
+}
+
+func TestPolicyBuild(t *testing.T) {
+	// ARP and the four neighbor discovery types always come first
+	neighbors := []string{"forward", "forward", "forward", "forward", "forward"}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		want   []string
+	}{
+		{
+			name:   "default allows everything",
+			policy: Policy{},
+			want:   []string{"forward 0.0.0.0/0", "forward ::/0"},
+		},
+		{
+			name: "local before block before allow",
+			policy: Policy{
+				Allow: []Rule{{CIDR: "10.1.0.0/16"}},
+				Block: []string{"10.1.2.0/24"},
+				Local: []Rule{{CIDR: "10.0.0.1/32", Protocol: "udp", Port: 67}},
+			},
+			want: []string{"accept 10.0.0.1/32", "drop 10.1.2.0/24", "forward 10.1.0.0/16"},
+		},
+		{
+			name:   "metadata blocked after explicit blocks",
+			policy: Policy{Block: []string{"192.0.2.0/24"}, BlockMetadata: true},
+			want: []string{
+				"drop 192.0.2.0/24",
+				"drop 169.254.0.0/16", "drop 100.100.100.200/32", "drop fd00:ec2::254/128",
+				"forward 0.0.0.0/0", "forward ::/0",
+			},
+		},
+		{
+			name:   "DNS only ignores allow",
+			policy: Policy{Allow: []Rule{{CIDR: "0.0.0.0/0"}}, DNSOnly: true, Resolvers: []string{"1.1.1.1"}},
+			want:   []string{"forward 1.1.1.1/32", "forward 1.1.1.1/32"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := tt.policy.build(7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, rule := range rules {
+				got = append(got, describe(rule))
+			}
+			want := append(append([]string{}, neighbors...), tt.want...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("build() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPolicyBuildErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+	}{
+		{"invalid block", Policy{Block: []string{"10.0.0.0"}}},
+		{"port without protocol", Policy{Allow: []Rule{{CIDR: "10.0.0.0/8", Port: 80}}}},
+		{"unknown protocol", Policy{Allow: []Rule{{CIDR: "10.0.0.0/8", Protocol: "sctp"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.policy.build(7); err == nil {
+				t.Error("build() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestApplyMissingNamespace(t *testing.T) {
+	err := Apply("/proc/self/ns/does-not-exist", "tap0", "eth0", Policy{})
+	if !errors.Is(err, netlink.ErrNamespaceNotFound) {
+		t.Errorf("Apply() = %v, want %v", err, netlink.ErrNamespaceNotFound)
+	}
+	err = Remove("/proc/self/ns/does-not-exist", "tap0")
+	if !errors.Is(err, netlink.ErrNamespaceNotFound) {
+		t.Errorf("Remove() = %v, want %v", err, netlink.ErrNamespaceNotFound)
+	}
+}
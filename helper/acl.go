@@ -0,0 +1,217 @@
+package helper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// aclXattr holds the access ACL of a file in the format of acl(5) the kernel
+// uses for the system.posix_acl_access extended attribute.
+const aclXattr = "system.posix_acl_access"
+
+const (
+	aclVersion     = 2
+	aclUndefinedID = 0xffffffff
+
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// minimalACL is the ACL the permission bits of mode amount to.
+func minimalACL(mode uint32) []aclEntry {
+	return []aclEntry{
+		{aclUserObj, uint16(mode>>6) & 7, aclUndefinedID},
+		{aclGroupObj, uint16(mode>>3) & 7, aclUndefinedID},
+		{aclOther, uint16(mode) & 7, aclUndefinedID},
+	}
+}
+
+func parseACL(data []byte) ([]aclEntry, error) {
+	if len(data) < 4 || (len(data)-4)%8 != 0 || binary.LittleEndian.Uint32(data) != aclVersion {
+		return nil, fmt.Errorf("invalid ACL")
+	}
+	var entries []aclEntry
+	for b := data[4:]; len(b) > 0; b = b[8:] {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return entries, nil
+}
+
+// formatACL sorts entries the way the kernel requires and sets the mask to
+// the permissions of the group class, without which named entries are not
+// valid.
+func formatACL(entries []aclEntry) []byte {
+	var kept []aclEntry
+	var mask uint16
+	named := false
+	for _, e := range entries {
+		switch e.tag {
+		case aclMask:
+			continue
+		case aclUser, aclGroup:
+			named = true
+			mask |= e.perm
+		case aclGroupObj:
+			mask |= e.perm
+		}
+		kept = append(kept, e)
+	}
+	if named {
+		kept = append(kept, aclEntry{aclMask, mask, aclUndefinedID})
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		if kept[i].tag != kept[j].tag {
+			return kept[i].tag < kept[j].tag
+		}
+		return kept[i].id < kept[j].id
+	})
+
+	data := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, e := range kept {
+		data = binary.LittleEndian.AppendUint16(data, e.tag)
+		data = binary.LittleEndian.AppendUint16(data, e.perm)
+		data = binary.LittleEndian.AppendUint32(data, e.id)
+	}
+	return data
+}
+
+// getACL returns the ACL of the file f, or nil if it has none beyond its
+// permission bits.
+func getACL(f *os.File) ([]aclEntry, error) {
+	buf := make([]byte, 4096)
+	n, err := unix.Fgetxattr(int(f.Fd()), aclXattr, buf)
+	if err == unix.ENODATA {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: f.Name(), Err: err}
+	}
+	return parseACL(buf[:n])
+}
+
+// grantAccess lets uid read the file f, and write it unless readOnly, and
+// reports whether it had to add an ACL entry for that, which only the owner
+// of f can. Nothing changes if others may access the file that way already.
+func grantAccess(f *os.File, st *unix.Stat_t, uid int, readOnly bool) (bool, error) {
+	perm := uint16(4)
+	if !readOnly {
+		perm |= 2
+	}
+	if uint16(st.Mode)&perm == perm {
+		return false, nil
+	}
+	entries, err := getACL(f)
+	if err != nil {
+		return false, err
+	}
+	if entries == nil {
+		entries = minimalACL(st.Mode)
+	}
+	found := false
+	for i, e := range entries {
+		if e.tag == aclUser && e.id == uint32(uid) {
+			if e.perm&perm == perm {
+				return false, nil
+			}
+			entries[i].perm |= perm
+			found = true
+		}
+	}
+	if !found {
+		entries = append(entries, aclEntry{aclUser, perm, uint32(uid)})
+	}
+	if err := unix.Fsetxattr(int(f.Fd()), aclXattr, formatACL(entries), 0); err != nil {
+		if err == unix.EPERM {
+			return false, fmt.Errorf("only the owner of %s can share it with the VM, unless others may access it", f.Name())
+		}
+		return false, &os.PathError{Op: "setxattr", Path: f.Name(), Err: err}
+	}
+	return true, nil
+}
+
+// revokeAccess removes the ACL entry of uid from the file at path, which is
+// not followed if it is a symlink.
+func revokeAccess(path string, uid int) error {
+	f, err := os.OpenFile(path, unix.O_PATH|unix.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return revokeFileAccess(f, uid)
+}
+
+// revokeFileAccess removes the ACL entry of uid from the file f, and the ACL
+// altogether once no named entries are left.
+func revokeFileAccess(f *os.File, uid int) error {
+	path := f.Name()
+	// f may be an O_PATH descriptor, whose xattrs can only be changed
+	// through its /proc/self/fd link
+	proc := fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+	buf := make([]byte, 4096)
+	n, err := unix.Getxattr(proc, aclXattr, buf)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	entries, err := parseACL(buf[:n])
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var kept []aclEntry
+	named := false
+	var groupPerm uint16
+	for _, e := range entries {
+		switch {
+		case e.tag == aclUser && e.id == uint32(uid):
+			continue
+		case e.tag == aclUser || e.tag == aclGroup:
+			named = true
+		case e.tag == aclGroupObj:
+			groupPerm = e.perm
+		}
+		kept = append(kept, e)
+	}
+	if len(kept) == len(entries) {
+		return nil
+	}
+	if named {
+		if err := unix.Setxattr(proc, aclXattr, formatACL(kept), 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+		return nil
+	}
+	// the group bits of the mode hold the mask while there is an ACL
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if err := unix.Removexattr(proc, aclXattr); err != nil {
+		return &os.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	mode := st.Mode&07707 | uint32(groupPerm)<<3
+	if err := unix.Chmod(proc, mode); err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package helper
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendFD passes fd to the other end of the socket conn.
+func sendFD(conn *os.File, fd int) error {
+	if err := unix.Sendmsg(int(conn.Fd()), []byte{0}, unix.UnixRights(fd), nil, 0); err != nil {
+		return fmt.Errorf("failed to pass file descriptor: %w", err)
+	}
+	return nil
+}
+
+// receiveFD receives the file descriptor sendFD passed on conn.
+func receiveFD(conn *os.File) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := unix.Recvmsg(int(conn.Fd()), make([]byte, 1), oob, unix.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		return -1, fmt.Errorf("failed to receive file descriptor: %w", err)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return -1, fmt.Errorf("helper passed no file descriptor")
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return -1, fmt.Errorf("helper passed no file descriptor")
+	}
+	return fds[0], nil
+}
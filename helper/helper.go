@@ -0,0 +1,266 @@
+// Package helper does the privileged work of a launch that the controller,
+// holding only the capabilities of privilege.Network, cannot do: starting the
+// jailer, the loop devices and device mapper targets of root drive snapshots,
+// placing the kernel and drives in the chroot and removing it, stopping the
+// jailed VMM, and opening the packet socket of the DNS proxy.
+//
+// Run as root, the operations execute in the calling process. Otherwise they
+// execute the firetest-helper binary at Path, which only root and members of
+// its group may execute. It holds the capabilities of privilege.Helper in its
+// permitted set and raises for each operation only the ones it needs:
+//
+//	claim, release             CAP_DAC_OVERRIDE, CAP_FOWNER, CAP_CHOWN
+//	jailer                     CAP_SETUID, to start the jailer as root
+//	grant-socket               CAP_CHOWN
+//	kill                       CAP_KILL
+//	place                      CAP_DAC_OVERRIDE, CAP_FOWNER, CAP_CHOWN, CAP_MKNOD
+//	remove-chroot              CAP_SYS_ADMIN, CAP_DAC_OVERRIDE
+//	attach-loop, detach-loop   CAP_DAC_OVERRIDE
+//	dm-create, dm-remove       CAP_SYS_ADMIN, CAP_DAC_OVERRIDE, CAP_MKNOD
+//	packet-socket              CAP_SYS_ADMIN, CAP_NET_RAW
+//
+// A VM's ID must be claimed with Claim before any other operation on the VM.
+// The helper records the claiming user, the identity the VMM runs as, which
+// /etc/subuid and /etc/subgid must delegate to that user, and the sandbox
+// namespace, which the user must be able to open. Every other operation on
+// the VM is checked against that record, and only starts JailerBinary and
+// FirecrackerBinary, in ChrootBaseDir.
+package helper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/vmid"
+)
+
+const (
+	// ChrootBaseDir is the only chroot base directory the helper works in.
+	ChrootBaseDir = "/srv/jailer"
+	// CgroupRoot is where the unified cgroup v2 hierarchy is mounted.
+	CgroupRoot = "/sys/fs/cgroup"
+	// RegistryDir keeps the helper's records of the claimed VMs, only root
+	// can write to it.
+	RegistryDir = "/var/lib/firetest-helper"
+	// Name is the file name of the helper binary.
+	Name = "firetest-helper"
+)
+
+// JailerBinary and FirecrackerBinary are the only binaries the helper starts,
+// set them with -ldflags -X at build time.
+var (
+	JailerBinary      = "/usr/local/bin/jailer"
+	FirecrackerBinary = "/usr/local/bin/firecracker"
+)
+
+// Path is the helper binary, by default next to the executable of the
+// process.
+var Path = defaultPath()
+
+func defaultPath() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return Name
+	}
+	return filepath.Join(filepath.Dir(exe), Name)
+}
+
+// inProcess reports whether the operations run in the calling process
+// instead of the helper.
+func inProcess() bool {
+	return os.Geteuid() == 0
+}
+
+// response is what the helper prints on stdout.
+type response struct {
+	Result    string   `json:"result,omitempty"`
+	Leftovers []string `json:"leftovers,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// call runs the helper operation op.
+func call(op string, stdin []byte, extra []*os.File, args ...string) (response, error) {
+	cmd := exec.Command(Path, append([]string{op}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.ExtraFiles = extra
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	runErr := cmd.Run()
+
+	var resp response
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		if runErr != nil {
+			return resp, fmt.Errorf("helper %s failed: %w: %s", op, runErr, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return resp, fmt.Errorf("invalid response of helper %s: %w", op, err)
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// Claim records VM id as the calling user's, running as uid and gid in the
+// namespace at nsPath, which may be empty. It fails if another user claimed
+// the ID.
+func Claim(id vmid.ID, uid, gid int, nsPath string) error {
+	if inProcess() {
+		return nil
+	}
+	_, err := call("claim", nil, nil, id.String(), strconv.Itoa(uid), strconv.Itoa(gid), nsPath)
+	return err
+}
+
+// Release forgets the claim of VM id, once all of its resources are gone.
+func Release(id vmid.ID) error {
+	if inProcess() {
+		return nil
+	}
+	_, err := call("release", nil, nil, id.String())
+	return err
+}
+
+// JailerCommand makes cmd, the jailer command the SDK built, run through the
+// helper, which starts the jailer as root the way it expects to be. The
+// process keeps its PID, the helper executes the jailer in its place.
+func JailerCommand(ctx context.Context, cmd *exec.Cmd) *exec.Cmd {
+	if inProcess() {
+		return cmd
+	}
+	wrapped := exec.CommandContext(ctx, Path, append([]string{"jailer", cmd.Path}, cmd.Args[1:]...)...)
+	wrapped.Stdin, wrapped.Stdout, wrapped.Stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+	wrapped.ExtraFiles = cmd.ExtraFiles
+	wrapped.SysProcAttr = cmd.SysProcAttr
+	return wrapped
+}
+
+// GrantSocket hands the API socket the jailed VMM created at path to the
+// calling user, so the controller can talk to the VMM.
+func GrantSocket(path string) error {
+	if inProcess() {
+		return nil
+	}
+	_, err := call("grant-socket", nil, nil, path)
+	return err
+}
+
+// Kill sends SIGTERM to the VMM of VM id running as pid.
+func Kill(id vmid.ID, pid int) error {
+	if inProcess() {
+		return kill(pid)
+	}
+	_, err := call("kill", nil, nil, id.String(), strconv.Itoa(pid))
+	return err
+}
+
+// Place makes the file at hostPath available to the VMM jailed in the chroot
+// at rootfs, running as uid and gid, and returns its chroot-relative path.
+// Regular files are hard linked as name, so the VM shares them with the
+// host; uid gets access to them through an ACL entry, which only the file's
+// owner can add, unless others may access them already. They must be on the
+// filesystem of ChrootBaseDir. Block devices get a node of the same path, or
+// named name below /dev, accessible to gid only. The helper ignores uid and
+// gid and uses the identity the VM was claimed with.
+func Place(rootfs, name, hostPath string, readOnly bool, uid, gid int) (string, error) {
+	if inProcess() {
+		f, err := openPlaced(hostPath, readOnly)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return place(rootfs, name, f, readOnly, uid, gid)
+	}
+	// the helper only takes absolute paths
+	hostPath, err := filepath.Abs(hostPath)
+	if err != nil {
+		return "", err
+	}
+	resp, err := call("place", nil, nil, rootfs, name, hostPath, strconv.FormatBool(readOnly))
+	return resp.Result, err
+}
+
+// RemoveChroot unmounts everything below the chroot dir, revokes the access
+// Place granted uid to shared files, removes the chroot and the VM's cgroup,
+// and lists the resources that are still there afterwards.
+func RemoveChroot(dir, cgroup string, uid int) (leftovers []string, err error) {
+	if inProcess() {
+		return removeChroot(dir, cgroup, uid)
+	}
+	resp, err := call("remove-chroot", nil, nil, dir, cgroup)
+	return resp.Leftovers, err
+}
+
+// AttachLoop attaches file to a free loop device and returns its path.
+func AttachLoop(file string, readOnly bool) (string, error) {
+	if inProcess() {
+		return attachLoop(file, readOnly)
+	}
+	resp, err := call("attach-loop", nil, nil, file, strconv.FormatBool(readOnly))
+	return resp.Result, err
+}
+
+// DetachLoop detaches the file backing the loop device at path.
+func DetachLoop(path string) error {
+	if inProcess() {
+		return detachLoop(path)
+	}
+	_, err := call("detach-loop", nil, nil, path)
+	return err
+}
+
+// DmCreate creates the device mapper target name from table.
+func DmCreate(name string, table []byte) error {
+	if inProcess() {
+		return dmCreate(name, table)
+	}
+	_, err := call("dm-create", table, nil, name)
+	return err
+}
+
+// DmRemove removes the device mapper target name.
+func DmRemove(name string) error {
+	if inProcess() {
+		return dmRemove(name)
+	}
+	_, err := call("dm-remove", nil, nil, name)
+	return err
+}
+
+// PacketSocket returns a non-blocking AF_PACKET socket in the namespace at
+// nsPath, not bound to any interface or protocol yet. The helper only opens
+// it in the namespace of a VM the caller claimed.
+func PacketSocket(nsPath string) (int, error) {
+	if inProcess() {
+		return packetSocket(nsPath)
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create socket pair: %w", err)
+	}
+	local, remote := os.NewFile(uintptr(fds[0]), "helper"), os.NewFile(uintptr(fds[1]), "helper")
+	defer local.Close()
+	_, err = call("packet-socket", nil, []*os.File{remote}, nsPath)
+	remote.Close()
+	if err != nil {
+		return -1, err
+	}
+	return receiveFD(local)
+}
+
+// Check reports the capabilities the helper lacks.
+func Check() error {
+	if inProcess() {
+		return nil
+	}
+	_, err := call("check", nil, nil)
+	return err
+}
@@ -0,0 +1,488 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/privilege"
+)
+
+// The capabilities each operation raises, only around the system calls that
+// need them. Files are opened with the caller's own permissions before.
+var (
+	writeRegistry = privilege.Requirement{
+		Operation: "recording the VMs of the caller",
+		Caps:      []privilege.Capability{privilege.CapDACOverride, privilege.CapFowner, privilege.CapChown},
+	}
+	placeFiles = privilege.Requirement{
+		Operation: "placing files in the jailer chroot",
+		Caps: []privilege.Capability{privilege.CapDACOverride, privilege.CapFowner, privilege.CapChown,
+			privilege.CapMknod},
+	}
+	chownSocket = privilege.Requirement{
+		Operation: "handing the API socket to the caller",
+		Caps:      []privilege.Capability{privilege.CapChown},
+	}
+	removeFiles = privilege.Requirement{
+		Operation: "removing the jailer chroot",
+		Caps:      []privilege.Capability{privilege.CapSysAdmin, privilege.CapDACOverride},
+	}
+	openDevices = privilege.Requirement{
+		Operation: "opening loop devices",
+		Caps:      []privilege.Capability{privilege.CapDACOverride},
+	}
+	killVMM = privilege.Requirement{
+		Operation: "stopping the jailed VMM",
+		Caps:      []privilege.Capability{privilege.CapKill},
+	}
+	openPacketSocket = privilege.Requirement{
+		Operation: "opening a packet socket in the sandbox",
+		Caps:      []privilege.Capability{privilege.CapSysAdmin, privilege.CapNetRaw},
+	}
+	runJailer = privilege.Requirement{
+		Operation: "starting the jailer as root",
+		Caps:      []privilege.Capability{privilege.CapSetUID},
+	}
+	// dmsetup gets them as ambient capabilities
+	runDmsetup = []privilege.Capability{privilege.CapSysAdmin, privilege.CapDACOverride, privilege.CapMknod}
+)
+
+// trustedDirs are searched for the binaries the helper runs itself.
+var trustedDirs = []string{"/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// cleanEnv is the environment of the binaries the helper runs.
+var cleanEnv = []string{"PATH=" + strings.Join(trustedDirs, ":")}
+
+func kill(pid int) error {
+	return privilege.Do(killVMM, func() error {
+		if err := unix.Kill(pid, unix.SIGTERM); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("failed to stop VMM %d: %w", pid, err)
+		}
+		return nil
+	})
+}
+
+// openPlaced opens the file at hostPath with the caller's own permissions,
+// for reading and writing unless readOnly.
+func openPlaced(hostPath string, readOnly bool) (*os.File, error) {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	return os.OpenFile(hostPath, flags|unix.O_NONBLOCK|unix.O_NOCTTY, 0)
+}
+
+// place works on the opened file f, not on the path it was opened by, which
+// may have changed since. Regular files are linked through /proc/self/fd,
+// the kernel image and drives are shared with the host instead of copied.
+func place(rootfs, name string, f *os.File, readOnly bool, uid, gid int) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return "", &os.PathError{Op: "stat", Path: f.Name(), Err: err}
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		chrootPath := "/" + name
+		target := filepath.Join(rootfs, chrootPath)
+		granted, err := grantAccess(f, &st, uid, readOnly)
+		if err != nil {
+			return "", err
+		}
+		err = privilege.Do(placeFiles, func() error {
+			return unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", f.Fd()),
+				unix.AT_FDCWD, target, unix.AT_SYMLINK_FOLLOW)
+		})
+		if err == nil {
+			return chrootPath, nil
+		}
+		if granted {
+			if revokeErr := revokeFileAccess(f, uid); revokeErr != nil {
+				err = errors.Join(err, revokeErr)
+			}
+		}
+		if errors.Is(err, unix.EXDEV) {
+			return "", fmt.Errorf("%s must be on the filesystem of %s to be shared with the VM", f.Name(), rootfs)
+		}
+		return "", &os.PathError{Op: "link", Path: target, Err: err}
+	case unix.S_IFBLK:
+		// device nodes of the same path are the same device
+		chrootPath := f.Name()
+		if !strings.HasPrefix(chrootPath, "/dev/") {
+			chrootPath = filepath.Join("/dev", name)
+		}
+		target := filepath.Join(rootfs, chrootPath)
+		// the node belongs to root, so the VMM can't widen its access
+		mode := uint32(0060)
+		if readOnly {
+			mode = 0040
+		}
+		if err := privilege.Do(placeFiles, func() error {
+			if err := mkdirRoot(rootfs, filepath.Dir(chrootPath)); err != nil {
+				return err
+			}
+			if err := unix.Mknod(target, unix.S_IFBLK|mode, int(st.Rdev)); err != nil {
+				return &os.PathError{Op: "mknod", Path: target, Err: err}
+			}
+			if err := os.Lchown(target, 0, gid); err != nil {
+				os.Remove(target)
+				return err
+			}
+			// mknod applies the umask
+			if err := os.Chmod(target, os.FileMode(mode)); err != nil {
+				os.Remove(target)
+				return err
+			}
+			return nil
+		}); err != nil {
+			return "", err
+		}
+		return chrootPath, nil
+	default:
+		return "", fmt.Errorf("%s is neither a regular file nor a block device", f.Name())
+	}
+}
+
+// mkdirRoot creates the directory dir, relative to rootfs, and its parents,
+// owned by root like the rest of the chroot.
+func mkdirRoot(rootfs, dir string) error {
+	path := rootfs
+	for _, elem := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		path = filepath.Join(path, elem)
+		err := unix.Mkdir(path, 0755)
+		if err == unix.EEXIST {
+			continue
+		}
+		if err != nil {
+			return &os.PathError{Op: "mkdir", Path: path, Err: err}
+		}
+		if err := os.Lchown(path, 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeChroot never descends into a mount that is still there. The files
+// place linked into the root of the chroot are the host's, they keep their
+// contents but lose the ACL entries granting uid access.
+func removeChroot(dir, cgroup string, uid int) ([]string, error) {
+	var errs []error
+	if err := revokeShared(filepath.Join(dir, "root"), uid); err != nil {
+		errs = append(errs, err)
+	}
+	if err := privilege.Do(removeFiles, func() error {
+		mounts, err := mountsUnder(dir)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, mount := range mounts {
+			if err := unix.Unmount(mount, unix.MNT_DETACH); err != nil && err != unix.EINVAL {
+				errs = append(errs, &os.PathError{Op: "unmount", Path: mount, Err: err})
+			}
+		}
+		if remaining, _ := mountsUnder(dir); len(remaining) == 0 {
+			if err := os.RemoveAll(dir); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if err := unix.Rmdir(cgroup); err != nil && err != unix.ENOENT {
+			errs = append(errs, &os.PathError{Op: "rmdir", Path: cgroup, Err: err})
+		}
+		return nil
+	}); err != nil {
+		errs = append(errs, err)
+	}
+
+	var leftovers []string
+	remaining, _ := mountsUnder(dir)
+	for _, mount := range remaining {
+		leftovers = append(leftovers, "mount "+mount)
+	}
+	if _, err := os.Stat(dir); err == nil {
+		leftovers = append(leftovers, "chroot "+dir)
+	}
+	if _, err := os.Stat(cgroup); err == nil {
+		leftovers = append(leftovers, "cgroup "+cgroup)
+	}
+	return leftovers, errors.Join(errs...)
+}
+
+// revokeShared revokes the access of uid to the files linked into rootfs
+// that are also linked elsewhere.
+func revokeShared(rootfs string, uid int) error {
+	entries, err := os.ReadDir(rootfs)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, entry := range entries {
+		path := filepath.Join(rootfs, entry.Name())
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFREG || st.Nlink < 2 {
+			continue
+		}
+		if err := revokeAccess(path, uid); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mountsUnder returns the mount points below dir, deepest first.
+func mountsUnder(dir string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mount := unescapeMountPath(fields[4])
+		if mount == dir || strings.HasPrefix(mount, dir+"/") {
+			mounts = append(mounts, mount)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %w", err)
+	}
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i]) > len(mounts[j]) })
+	return mounts, nil
+}
+
+// mountinfo escapes whitespace and backslashes in paths as octal.
+var mountPathUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+func unescapeMountPath(path string) string {
+	return mountPathUnescaper.Replace(path)
+}
+
+// attachLoop is losetup --find for file, which is opened with the caller's
+// own permissions. The device is read-only if the file is.
+func attachLoop(file string, readOnly bool) (string, error) {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	back, err := os.OpenFile(file, flags, 0)
+	if err != nil {
+		return "", err
+	}
+	defer back.Close()
+	name, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+
+	var path string
+	err = privilege.Do(openDevices, func() error {
+		ctrl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		defer ctrl.Close()
+		// another process may take the free device first
+		for attempt := 0; attempt < 5; attempt++ {
+			n, err := unix.IoctlRetInt(int(ctrl.Fd()), unix.LOOP_CTL_GET_FREE)
+			if err != nil {
+				return fmt.Errorf("failed to find a free loop device: %w", err)
+			}
+			path = fmt.Sprintf("/dev/loop%d", n)
+			loop, err := os.OpenFile(path, flags, 0)
+			if err != nil {
+				return err
+			}
+			err = unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_SET_FD, int(back.Fd()))
+			if err == unix.EBUSY {
+				loop.Close()
+				continue
+			}
+			if err != nil {
+				loop.Close()
+				return fmt.Errorf("failed to attach %s to %s: %w", file, path, err)
+			}
+			info := unix.LoopInfo64{}
+			copy(info.File_name[:], name)
+			if err := unix.IoctlLoopSetStatus64(int(loop.Fd()), &info); err != nil {
+				unix.IoctlSetInt(int(loop.Fd()), unix.LOOP_CLR_FD, 0)
+				loop.Close()
+				return fmt.Errorf("failed to name %s: %w", path, err)
+			}
+			return loop.Close()
+		}
+		return fmt.Errorf("failed to attach %s: loop devices are busy", file)
+	})
+	return path, err
+}
+
+// detachLoop is losetup -d for a loop device given by path.
+func detachLoop(path string) error {
+	return privilege.Do(openDevices, func() error {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := unix.IoctlSetInt(int(f.Fd()), unix.LOOP_CLR_FD, 0); err != nil && err != unix.ENXIO {
+			return fmt.Errorf("failed to detach %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// dmsetup is found in trustedDirs only, it runs with capabilities.
+func dmsetup(args ...string) *exec.Cmd {
+	path := "dmsetup"
+	for _, dir := range trustedDirs {
+		if trusted(filepath.Join(dir, "dmsetup")) == nil {
+			path = filepath.Join(dir, "dmsetup")
+			break
+		}
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = cleanEnv
+	privilege.Inherit(cmd, runDmsetup...)
+	return cmd
+}
+
+func dmCreate(name string, table []byte) error {
+	// if udevd is not running, dmsetup manages the device node in /dev/mapper
+	cmd := dmsetup("create", "--verifyudev", name)
+	cmd.Stdin = bytes.NewReader(table)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %q exited with %q: %w", cmd.Args, out, err)
+	}
+	return nil
+}
+
+func dmRemove(name string) error {
+	cmd := dmsetup("remove", name)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %q exited with %q: %w", cmd.Args, out, err)
+	}
+	return nil
+}
+
+// packetSocket opens the socket on a thread of its own switched into the
+// namespace. The namespace is opened with the caller's own permissions. If
+// the thread cannot be switched back or drop the capabilities it is left
+// locked, which makes the Go runtime terminate it.
+func packetSocket(nsPath string) (int, error) {
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open namespace %s: %w", nsPath, err)
+	}
+	defer ns.Close()
+
+	type result struct {
+		fd  int
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		restore, err := privilege.Raise(openPacketSocket)
+		if err != nil {
+			runtime.UnlockOSThread()
+			ch <- result{-1, err}
+			return
+		}
+		host, err := netns.Get()
+		if err != nil {
+			ch <- result{-1, errors.Join(err, dropCaps(restore))}
+			return
+		}
+		defer host.Close()
+		if err := netns.Set(ns); err != nil {
+			ch <- result{-1, errors.Join(fmt.Errorf("failed to enter namespace %s: %w", nsPath, err), dropCaps(restore))}
+			return
+		}
+		// no protocol until the filter is attached, so nothing is queued
+		fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+		if setErr := netns.Set(host); setErr != nil {
+			// the thread is stuck in ns, keep it locked so it dies with us
+			if err == nil {
+				unix.Close(fd)
+			}
+			ch <- result{-1, fmt.Errorf("failed to restore namespace: %w", setErr)}
+			return
+		}
+		if dropErr := dropCaps(restore); dropErr != nil {
+			if err == nil {
+				unix.Close(fd)
+			}
+			ch <- result{-1, dropErr}
+			return
+		}
+		ch <- result{fd, err}
+	}()
+	r := <-ch
+	if r.err != nil {
+		return -1, fmt.Errorf("failed to open packet socket: %w", r.err)
+	}
+	return r.fd, nil
+}
+
+// dropCaps restores the capabilities of a locked thread and unlocks it,
+// unless they are still raised.
+func dropCaps(restore func() error) error {
+	if err := restore(); err != nil {
+		return err
+	}
+	runtime.UnlockOSThread()
+	return nil
+}
+
+// trusted checks that path and every directory above it, before and after
+// resolving symlinks, is owned by root and writable by nobody else, so the
+// caller cannot swap the binary the helper runs with capabilities.
+func trusted(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{abs, resolved} {
+		for q := p; ; q = filepath.Dir(q) {
+			var st unix.Stat_t
+			if err := unix.Stat(q, &st); err != nil {
+				return &os.PathError{Op: "stat", Path: q, Err: err}
+			}
+			if st.Uid != 0 || st.Mode&0022 != 0 {
+				return fmt.Errorf("%s is not trusted: %s is not owned by root or writable by others", path, q)
+			}
+			if q == "/" {
+				break
+			}
+		}
+	}
+	return nil
+}
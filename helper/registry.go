@@ -0,0 +1,164 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/privilege"
+	"ranjankuldeep/test/vmid"
+)
+
+// claim is the helper's record of a VM, which the operations on the VM are
+// checked against.
+type claim struct {
+	ID vmid.ID `json:"id"`
+	// Owner is the user that claimed the VM.
+	Owner int `json:"owner"`
+	// UID and GID are the identity the VMM runs as.
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	NetNS string `json:"netns,omitempty"`
+}
+
+func claimPath(id vmid.ID) string {
+	return filepath.Join(RegistryDir, id.String()+".json")
+}
+
+// openRegistry creates RegistryDir unless it exists, checks that only root
+// can write to it and returns it locked, claims are made one at a time.
+func openRegistry() (*os.File, error) {
+	if err := privilege.Do(writeRegistry, func() error {
+		err := unix.Mkdir(RegistryDir, 0755)
+		if err == unix.EEXIST {
+			return nil
+		}
+		if err != nil {
+			return &os.PathError{Op: "mkdir", Path: RegistryDir, Err: err}
+		}
+		return os.Lchown(RegistryDir, 0, 0)
+	}); err != nil {
+		return nil, err
+	}
+	if err := trusted(RegistryDir); err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(RegistryDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", RegistryDir, err)
+	}
+	return dir, nil
+}
+
+// lookupClaim reads the claim of VM id. Only claims written by the helper,
+// owned by root, count.
+func lookupClaim(id vmid.ID) (claim, error) {
+	path := claimPath(id)
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err == unix.ENOENT {
+		return claim{}, fmt.Errorf("VM %s is not claimed", id)
+	} else if err != nil {
+		return claim{}, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFREG || st.Uid != 0 || st.Mode&0022 != 0 {
+		return claim{}, fmt.Errorf("%s was not written by the helper", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return claim{}, err
+	}
+	var c claim
+	if err := json.Unmarshal(data, &c); err != nil {
+		return claim{}, fmt.Errorf("invalid claim %s: %w", path, err)
+	}
+	if c.ID != id {
+		return claim{}, fmt.Errorf("claim %s is not of VM %s", path, id)
+	}
+	return c, nil
+}
+
+// owned returns the claim of VM id, if the caller made it.
+func owned(id vmid.ID) (claim, error) {
+	c, err := lookupClaim(id)
+	if err != nil {
+		return claim{}, err
+	}
+	if c.Owner != os.Getuid() {
+		return claim{}, fmt.Errorf("VM %s belongs to user %d", id, c.Owner)
+	}
+	return c, nil
+}
+
+// ownedClaims returns the claims the caller made.
+func ownedClaims() ([]claim, error) {
+	entries, err := os.ReadDir(RegistryDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var claims []claim
+	for _, entry := range entries {
+		id, err := vmid.Parse(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		if c, err := owned(id); err == nil {
+			claims = append(claims, c)
+		}
+	}
+	return claims, nil
+}
+
+// writeClaim replaces the claim of c.ID. The file is only linked into
+// RegistryDir once it belongs to root and is complete, the caller never gets
+// to open it.
+func writeClaim(c claim) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	path := claimPath(c.ID)
+	return privilege.Do(writeRegistry, func() error {
+		f, err := os.OpenFile(RegistryDir, os.O_WRONLY|unix.O_TMPFILE, 0644)
+		if err != nil {
+			return &os.PathError{Op: "create", Path: RegistryDir, Err: err}
+		}
+		defer f.Close()
+		if err := f.Chown(0, 0); err != nil {
+			return err
+		}
+		if err := f.Chmod(0644); err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+		tmp := path + ".tmp"
+		os.Remove(tmp)
+		if err := unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", f.Fd()),
+			unix.AT_FDCWD, tmp, unix.AT_SYMLINK_FOLLOW); err != nil {
+			return &os.PathError{Op: "link", Path: tmp, Err: err}
+		}
+		return os.Rename(tmp, path)
+	})
+}
+
+// removeClaim forgets the claim of VM id.
+func removeClaim(id vmid.ID) error {
+	return privilege.Do(writeRegistry, func() error {
+		if err := os.Remove(claimPath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
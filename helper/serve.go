@@ -0,0 +1,602 @@
+package helper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/idalloc"
+	"ranjankuldeep/test/privilege"
+	"ranjankuldeep/test/vmid"
+)
+
+// operation is one thing the helper binary does for its caller, after
+// checking the arguments are something the caller may ask for.
+type operation struct {
+	args int
+	run  func(args []string, stdin io.Reader) (response, error)
+}
+
+var operations = map[string]operation{
+	"check":         {0, serveCheck},
+	"claim":         {4, serveClaim},
+	"release":       {1, serveRelease},
+	"grant-socket":  {1, serveGrantSocket},
+	"kill":          {2, serveKill},
+	"place":         {4, servePlace},
+	"remove-chroot": {2, serveRemoveChroot},
+	"attach-loop":   {2, serveAttachLoop},
+	"detach-loop":   {1, serveDetachLoop},
+	"dm-create":     {1, serveDmCreate},
+	"dm-remove":     {1, serveDmRemove},
+	"packet-socket": {1, servePacketSocket},
+}
+
+// Main runs the operation named by args[0] with the rest of args, writes its
+// response to stdout and returns the exit status. It is the firetest-helper
+// binary. The jailer operation does not return, the helper becomes the
+// jailer.
+func Main(args []string) int {
+	if len(args) > 1 && args[0] == "jailer" {
+		err := serveJailer(args[1], args[2:])
+		fmt.Fprintf(os.Stderr, "%s: %v\n", Name, err)
+		return 1
+	}
+
+	var resp response
+	var err error
+	if len(args) == 0 {
+		err = fmt.Errorf("usage: %s <operation> [arguments]", Name)
+	} else if op, ok := operations[args[0]]; !ok {
+		err = fmt.Errorf("unknown operation %q", args[0])
+	} else if len(args)-1 != op.args {
+		err = fmt.Errorf("%s takes %d arguments, got %d", args[0], op.args, len(args)-1)
+	} else {
+		resp, err = op.run(args[1:], os.Stdin)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(resp); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", Name, err)
+		return 1
+	}
+	if resp.Error != "" {
+		return 1
+	}
+	return 0
+}
+
+func serveCheck([]string, io.Reader) (response, error) {
+	return response{}, privilege.Check(privilege.Helper)
+}
+
+// delegated checks that the VMM may run as uid and gid, IDs /etc/subuid and
+// /etc/subgid delegate to the caller.
+func delegated(uid, gid int) error {
+	r, err := idalloc.CurrentRange()
+	if err != nil {
+		return err
+	}
+	if !r.Contains(uid) || !r.Contains(gid) {
+		return fmt.Errorf("%d:%d is not a subordinate identity of user %d", uid, gid, os.Getuid())
+	}
+	return nil
+}
+
+// callerNS checks that the caller can open the namespace at path itself and
+// that it is not the host's, where the VMM would share the host's network.
+func callerNS(path string) error {
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return fmt.Errorf("failed to open namespace %s: %w", path, err)
+	}
+	defer ns.Close()
+	host, err := netns.GetFromPath("/proc/self/ns/net")
+	if err != nil {
+		return err
+	}
+	defer host.Close()
+	if ns.Equal(host) {
+		return fmt.Errorf("%s is the host namespace", path)
+	}
+	return nil
+}
+
+func parseID(s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid user or group ID %q", s)
+	}
+	return id, nil
+}
+
+// serveClaim records the VM as the caller's, unless another user claimed it.
+func serveClaim(args []string, _ io.Reader) (response, error) {
+	id, err := vmid.Parse(args[0])
+	if err != nil {
+		return response{}, err
+	}
+	uid, err := parseID(args[1])
+	if err != nil {
+		return response{}, err
+	}
+	gid, err := parseID(args[2])
+	if err != nil {
+		return response{}, err
+	}
+	if err := delegated(uid, gid); err != nil {
+		return response{}, err
+	}
+	if args[3] != "" {
+		if err := callerNS(args[3]); err != nil {
+			return response{}, err
+		}
+	}
+
+	registry, err := openRegistry()
+	if err != nil {
+		return response{}, err
+	}
+	defer registry.Close()
+	if c, err := lookupClaim(id); err == nil && c.Owner != os.Getuid() {
+		return response{}, fmt.Errorf("VM %s belongs to user %d", id, c.Owner)
+	}
+	return response{}, writeClaim(claim{ID: id, Owner: os.Getuid(), UID: uid, GID: gid, NetNS: args[3]})
+}
+
+// serveRelease keeps the claim while the chroot or root drive snapshot of
+// the VM is left, so no other user can claim them.
+func serveRelease(args []string, _ io.Reader) (response, error) {
+	id, err := vmid.Parse(args[0])
+	if err != nil {
+		return response{}, err
+	}
+	registry, err := openRegistry()
+	if err != nil {
+		return response{}, err
+	}
+	defer registry.Close()
+	if _, err := owned(id); err != nil {
+		return response{}, err
+	}
+	for _, path := range []string{
+		id.ChrootDir(ChrootBaseDir, FirecrackerBinary),
+		"/dev/mapper/" + id.OverlayName(),
+		"/dev/mapper/" + id.BaseName(),
+	} {
+		if _, err := os.Lstat(path); err == nil {
+			return response{}, fmt.Errorf("VM %s still has %s", id, path)
+		}
+	}
+	return response{}, removeClaim(id)
+}
+
+// chrootOf returns the VM whose chroot is dir.
+func chrootOf(dir string) (vmid.ID, error) {
+	id, err := vmid.Parse(filepath.Base(dir))
+	if err != nil || dir != id.ChrootDir(ChrootBaseDir, FirecrackerBinary) {
+		return "", fmt.Errorf("%s is not the chroot of a VM", dir)
+	}
+	return id, nil
+}
+
+// rootfsOf returns the VM whose chroot has the root directory rootfs, which
+// the jailer created.
+func rootfsOf(rootfs string) (vmid.ID, error) {
+	if filepath.Base(rootfs) != "root" {
+		return "", fmt.Errorf("%s is not the root of a chroot", rootfs)
+	}
+	id, err := chrootOf(filepath.Dir(rootfs))
+	if err != nil {
+		return "", err
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(rootfs, &st); err != nil {
+		return "", &os.PathError{Op: "lstat", Path: rootfs, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR || st.Uid != 0 {
+		return "", fmt.Errorf("%s is not a directory owned by root", rootfs)
+	}
+	return id, nil
+}
+
+// serveGrantSocket chowns the socket the VMM created to the caller, the VMM
+// keeps serving it.
+func serveGrantSocket(args []string, _ io.Reader) (response, error) {
+	path := args[0]
+	id, err := rootfsOf(filepath.Dir(path))
+	if err != nil {
+		return response{}, err
+	}
+	c, err := owned(id)
+	if err != nil {
+		return response{}, err
+	}
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return response{}, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFSOCK || st.Uid != uint32(c.UID) {
+		return response{}, fmt.Errorf("%s is not a socket of VM %s", path, id)
+	}
+	return response{}, privilege.Do(chownSocket, func() error {
+		return unix.Fchownat(unix.AT_FDCWD, path, os.Getuid(), os.Getgid(), unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+// serveKill only signals the VM's VMM: a process running as the VM's
+// identity in the VM's cgroup.
+func serveKill(args []string, _ io.Reader) (response, error) {
+	id, err := vmid.Parse(args[0])
+	if err != nil {
+		return response{}, err
+	}
+	c, err := owned(id)
+	if err != nil {
+		return response{}, err
+	}
+	pid, err := strconv.Atoi(args[1])
+	if err != nil || pid <= 0 {
+		return response{}, fmt.Errorf("invalid PID %q", args[1])
+	}
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if os.IsNotExist(err) {
+		return response{}, nil
+	}
+	if err != nil {
+		return response{}, err
+	}
+	cgroup, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return response{}, err
+	}
+	if !hasUID(string(status), c.UID) || !strings.HasSuffix(strings.TrimSpace(string(cgroup)), "/"+id.String()) {
+		return response{}, fmt.Errorf("process %d is not the VMM of VM %s", pid, id)
+	}
+	return response{}, kill(pid)
+}
+
+// hasUID reports whether the process with the /proc/<pid>/status status
+// runs as uid, with all of its user IDs.
+func hasUID(status string, uid int) bool {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "Uid:" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if field != strconv.Itoa(uid) {
+				return false
+			}
+		}
+		return len(fields) > 1
+	}
+	return false
+}
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// servePlace places files the caller can open itself, or the VM's own root
+// drive snapshot, which only the helper can open. The identity is the one
+// the VM was claimed with.
+func servePlace(args []string, _ io.Reader) (response, error) {
+	rootfs, name, hostPath := args[0], args[1], args[2]
+	id, err := rootfsOf(rootfs)
+	if err != nil {
+		return response{}, err
+	}
+	c, err := owned(id)
+	if err != nil {
+		return response{}, err
+	}
+	if !namePattern.MatchString(name) {
+		return response{}, fmt.Errorf("invalid file name %q", name)
+	}
+	if filepath.Clean(hostPath) != hostPath || !filepath.IsAbs(hostPath) {
+		return response{}, fmt.Errorf("%s is not a clean absolute path", hostPath)
+	}
+	readOnly, err := strconv.ParseBool(args[3])
+	if err != nil {
+		return response{}, err
+	}
+
+	var f *os.File
+	if hostPath == "/dev/mapper/"+id.OverlayName() {
+		err = privilege.Do(openDevices, func() error {
+			f, err = openPlaced(hostPath, readOnly)
+			return err
+		})
+	} else {
+		f, err = openPlaced(hostPath, readOnly)
+	}
+	if err != nil {
+		return response{}, err
+	}
+	defer f.Close()
+	path, err := place(rootfs, name, f, readOnly, c.UID, c.GID)
+	return response{Result: path}, err
+}
+
+func serveRemoveChroot(args []string, _ io.Reader) (response, error) {
+	dir, cgroup := args[0], args[1]
+	id, err := chrootOf(dir)
+	if err != nil {
+		return response{}, err
+	}
+	c, err := owned(id)
+	if err != nil {
+		return response{}, err
+	}
+	if cgroup != filepath.Join(CgroupRoot, filepath.Base(FirecrackerBinary), id.String()) {
+		return response{}, fmt.Errorf("%s is not the cgroup of VM %s", cgroup, id)
+	}
+	leftovers, err := removeChroot(dir, cgroup, c.UID)
+	return response{Leftovers: leftovers}, err
+}
+
+func serveAttachLoop(args []string, _ io.Reader) (response, error) {
+	readOnly, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return response{}, err
+	}
+	// the file is opened with the caller's permissions
+	path, err := attachLoop(args[0], readOnly)
+	return response{Result: path}, err
+}
+
+var loopPattern = regexp.MustCompile(`^/dev/loop[0-9]+$`)
+
+// loopBackingFile returns the file attached to the loop device at path,
+// which the caller must be able to access with mode itself.
+func loopBackingFile(path string, mode uint32) (string, error) {
+	if !loopPattern.MatchString(path) {
+		return "", fmt.Errorf("%s is not a loop device", path)
+	}
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(path), "loop/backing_file"))
+	if err != nil {
+		return "", fmt.Errorf("%s is not attached: %w", path, err)
+	}
+	file := strings.TrimSpace(string(data))
+	if err := unix.Access(file, mode); err != nil {
+		return "", &os.PathError{Op: "access", Path: file, Err: err}
+	}
+	return file, nil
+}
+
+func serveDetachLoop(args []string, _ io.Reader) (response, error) {
+	if _, err := loopBackingFile(args[0], unix.R_OK); err != nil {
+		return response{}, err
+	}
+	return response{}, detachLoop(args[0])
+}
+
+// dmName checks that name is a device mapper target of the root drive
+// snapshot of a VM the caller claimed and returns the VM's ID.
+func dmName(name string) (vmid.ID, error) {
+	for _, prefix := range []string{"base-", "overlay-"} {
+		if strings.HasPrefix(name, prefix) {
+			id, err := vmid.Parse(strings.TrimPrefix(name, prefix))
+			if err != nil {
+				return "", err
+			}
+			_, err = owned(id)
+			return id, err
+		}
+	}
+	return "", fmt.Errorf("%s is not a root drive snapshot", name)
+}
+
+// checkTable accepts the tables snapshot.CreateDeviceMapper builds: the base
+// target maps a loop device of a file the caller can read, the overlay
+// snapshots the base target of the same VM into a loop device of a file the
+// caller can write.
+func checkTable(id vmid.ID, name string, table []byte) error {
+	for _, line := range strings.Split(strings.TrimSpace(string(table)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return fmt.Errorf("invalid table line %q", line)
+		}
+		target, params := fields[2], fields[3:]
+		var err error
+		switch {
+		case name == id.BaseName() && target == "linear" && len(params) == 2:
+			_, err = loopBackingFile(params[0], unix.R_OK)
+		case name == id.BaseName() && target == "zero" && len(params) == 0:
+		case name == id.OverlayName() && target == "snapshot" && len(params) == 4:
+			if params[0] != "/dev/mapper/"+id.BaseName() {
+				err = fmt.Errorf("snapshot origin %s is not the base of VM %s", params[0], id)
+			} else {
+				_, err = loopBackingFile(params[1], unix.R_OK|unix.W_OK)
+			}
+		default:
+			err = fmt.Errorf("table line %q is not allowed for %s", line, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serveDmCreate(args []string, stdin io.Reader) (response, error) {
+	name := args[0]
+	id, err := dmName(name)
+	if err != nil {
+		return response{}, err
+	}
+	table, err := io.ReadAll(stdin)
+	if err != nil {
+		return response{}, err
+	}
+	if err := checkTable(id, name, table); err != nil {
+		return response{}, err
+	}
+	return response{}, dmCreate(name, table)
+}
+
+func serveDmRemove(args []string, _ io.Reader) (response, error) {
+	if _, err := dmName(args[0]); err != nil {
+		return response{}, err
+	}
+	return response{}, dmRemove(args[0])
+}
+
+// servePacketSocket passes the socket on the file descriptor 3 the caller
+// gave the helper, for the namespace of a VM the caller claimed only.
+func servePacketSocket(args []string, _ io.Reader) (response, error) {
+	nsPath := args[0]
+	claims, err := ownedClaims()
+	if err != nil {
+		return response{}, err
+	}
+	found := false
+	for _, c := range claims {
+		found = found || c.NetNS == nsPath
+	}
+	if !found {
+		return response{}, fmt.Errorf("%s is not the namespace of a VM of user %d", nsPath, os.Getuid())
+	}
+	if err := callerNS(nsPath); err != nil {
+		return response{}, err
+	}
+	fd, err := packetSocket(nsPath)
+	if err != nil {
+		return response{}, err
+	}
+	defer unix.Close(fd)
+	conn := os.NewFile(3, "caller")
+	defer conn.Close()
+	return response{}, sendFD(conn, fd)
+}
+
+// cgroupFiles are the files the jailer may write in the VM's cgroup, the
+// ones of Resources and NUMA placement.
+var cgroupFiles = map[string]bool{
+	"cpuset.mems": true,
+	"cpuset.cpus": true,
+	"cpu.max":     true,
+	"cpu.weight":  true,
+	"memory.max":  true,
+	"io.max":      true,
+	"pids.max":    true,
+}
+
+// jailerArgs are the jailer flags the SDK passes, before the -- separating
+// the arguments of the VMM.
+type jailerArgs struct {
+	flags     map[string]string
+	cgroups   []string
+	daemonize bool
+}
+
+// parseJailerArgs rejects every flag the SDK does not use and repeated flags,
+// except --cgroup.
+func parseJailerArgs(args []string) (jailerArgs, error) {
+	a := jailerArgs{flags: map[string]string{}}
+	for i := 0; i < len(args) && args[i] != "--"; i++ {
+		flag := args[i]
+		switch flag {
+		case "--daemonize":
+			a.daemonize = true
+			continue
+		case "--id", "--uid", "--gid", "--exec-file", "--chroot-base-dir", "--netns", "--cgroup-version", "--cgroup":
+		default:
+			return a, fmt.Errorf("jailer flag %q is not allowed", flag)
+		}
+		if i+1 >= len(args) {
+			return a, fmt.Errorf("jailer flag %s has no value", flag)
+		}
+		i++
+		if flag == "--cgroup" {
+			a.cgroups = append(a.cgroups, args[i])
+			continue
+		}
+		if _, ok := a.flags[flag]; ok {
+			return a, fmt.Errorf("jailer flag %s is repeated", flag)
+		}
+		a.flags[flag] = args[i]
+	}
+	return a, nil
+}
+
+// check validates the flags against the claim of the VM.
+func (a jailerArgs) check(c claim) error {
+	switch {
+	case a.flags["--id"] != c.ID.String():
+		return fmt.Errorf("jailer ID %q is not VM %s", a.flags["--id"], c.ID)
+	case a.flags["--uid"] != strconv.Itoa(c.UID) || a.flags["--gid"] != strconv.Itoa(c.GID):
+		return fmt.Errorf("VM %s runs as %d:%d", c.ID, c.UID, c.GID)
+	case a.flags["--exec-file"] != FirecrackerBinary:
+		return fmt.Errorf("the jailed binary must be %s", FirecrackerBinary)
+	case a.flags["--chroot-base-dir"] != ChrootBaseDir:
+		return fmt.Errorf("the chroot base directory must be %s", ChrootBaseDir)
+	case a.flags["--cgroup-version"] != "2":
+		return fmt.Errorf("the jailer must use cgroup v2")
+	case a.flags["--netns"] != c.NetNS:
+		return fmt.Errorf("VM %s runs in namespace %q", c.ID, c.NetNS)
+	}
+	for _, cg := range a.cgroups {
+		file, value, ok := strings.Cut(cg, "=")
+		if !ok || !cgroupFiles[file] || strings.ContainsAny(value, "\n") {
+			return fmt.Errorf("jailer cgroup setting %q is not allowed", cg)
+		}
+	}
+	return nil
+}
+
+// serveJailer executes the jailer in place of the helper with root as its
+// real, effective and saved user ID, as the jailer expects to be started; it
+// drops to the VM's identity itself before executing the VMM. Only
+// JailerBinary is started, for a VM the caller claimed, with the identity
+// and namespace of the claim.
+func serveJailer(jailer string, args []string) error {
+	if jailer != JailerBinary {
+		return fmt.Errorf("the jailer must be %s", JailerBinary)
+	}
+	for _, binary := range []string{JailerBinary, FirecrackerBinary} {
+		if err := trusted(binary); err != nil {
+			return err
+		}
+	}
+	a, err := parseJailerArgs(args)
+	if err != nil {
+		return err
+	}
+	id, err := vmid.Parse(a.flags["--id"])
+	if err != nil {
+		return err
+	}
+	c, err := owned(id)
+	if err != nil {
+		return err
+	}
+	if err := a.check(c); err != nil {
+		return err
+	}
+	if c.NetNS != "" {
+		if err := callerNS(c.NetNS); err != nil {
+			return err
+		}
+	}
+
+	// the credentials of the executing thread are the ones the jailer gets,
+	// set them on this thread only, it never runs Go code again
+	runtime.LockOSThread()
+	if _, err := privilege.Raise(runJailer); err != nil {
+		return err
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_SETRESUID, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to become root: %w", errno)
+	}
+	return unix.Exec(jailer, append([]string{jailer}, args...), cleanEnv)
+}
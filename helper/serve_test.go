@@ -0,0 +1,162 @@
+package helper
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"ranjankuldeep/test/vmid"
+)
+
+func jailerFlags(c claim, extra ...string) []string {
+	args := []string{
+		"--id", c.ID.String(), "--uid", "100001", "--gid", "100002",
+		"--exec-file", FirecrackerBinary,
+		"--cgroup", "cpuset.mems=0", "--cgroup", "cpuset.cpus=0-1",
+		"--cgroup-version", "2",
+		"--chroot-base-dir", ChrootBaseDir,
+		"--netns", c.NetNS,
+		"--daemonize",
+	}
+	return append(append(args, extra...), "--", "--api-sock", "/firecracker.socket")
+}
+
+func TestJailerArgs(t *testing.T) {
+	c := claim{ID: vmid.ID("vm-1"), Owner: 1000, UID: 100001, GID: 100002, NetNS: "/var/run/netns/vm-1"}
+	replace := func(flag, value string) []string {
+		args := jailerFlags(c)
+		for i := range args {
+			if args[i] == flag {
+				args[i+1] = value
+				break
+			}
+		}
+		return args
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "sdk", args: jailerFlags(c)},
+		{name: "quota", args: jailerFlags(c, "--cgroup", "cpu.max=50000 100000")},
+		{name: "other vm", args: replace("--id", "vm-2"), wantErr: true},
+		{name: "other uid", args: replace("--uid", "0"), wantErr: true},
+		{name: "other gid", args: replace("--gid", "0"), wantErr: true},
+		{name: "other binary", args: replace("--exec-file", "/bin/sh"), wantErr: true},
+		{name: "other base dir", args: replace("--chroot-base-dir", "/"), wantErr: true},
+		{name: "host namespace", args: replace("--netns", "/proc/1/ns/net"), wantErr: true},
+		{name: "cgroup v1", args: replace("--cgroup-version", "1"), wantErr: true},
+		{name: "repeated", args: jailerFlags(c, "--uid", "0"), wantErr: true},
+		{name: "unknown flag", args: jailerFlags(c, "--parent-cgroup", "/"), wantErr: true},
+		{name: "cgroup file", args: jailerFlags(c, "--cgroup", "cgroup.procs=1"), wantErr: true},
+		{name: "cgroup newline", args: jailerFlags(c, "--cgroup", "pids.max=1\n2"), wantErr: true},
+		{name: "no value", args: []string{"--id"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		a, err := parseJailerArgs(tt.args)
+		if err == nil {
+			err = a.check(c)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseJailerArgsStopsAtSeparator(t *testing.T) {
+	a, err := parseJailerArgs([]string{"--id", "vm-1", "--", "--id", "vm-2", "--no-api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.flags["--id"] != "vm-1" {
+		t.Errorf("--id = %q, want vm-1", a.flags["--id"])
+	}
+}
+
+func TestChrootOf(t *testing.T) {
+	id := vmid.ID("vm-1")
+	dir := id.ChrootDir(ChrootBaseDir, FirecrackerBinary)
+	if got, err := chrootOf(dir); err != nil || got != id {
+		t.Errorf("chrootOf(%s) = %s, %v, want %s", dir, got, err, id)
+	}
+	for _, dir := range []string{
+		dir + "/root",
+		dir + "/",
+		"/tmp/firecracker/vm-1",
+		ChrootBaseDir + "/jailer/vm-1",
+		ChrootBaseDir + "/firecracker/..",
+		ChrootBaseDir + "/firecracker/vm_1",
+	} {
+		if _, err := chrootOf(dir); err == nil {
+			t.Errorf("chrootOf(%s) succeeded", dir)
+		}
+	}
+}
+
+func TestHasUID(t *testing.T) {
+	status := "Name:\tfirecracker\nUid:\t100001\t100001\t100001\t100001\nGid:\t100002\t100002\t100002\t100002\n"
+	if !hasUID(status, 100001) {
+		t.Error("hasUID() = false for the VM's identity")
+	}
+	if hasUID(status, 0) {
+		t.Error("hasUID() = true for another identity")
+	}
+	mixed := strings.Replace(status, "100001\t100001\t100001\t100001", "100001\t0\t0\t0", 1)
+	if hasUID(mixed, 100001) {
+		t.Error("hasUID() = true with a root effective ID")
+	}
+	if hasUID("Name:\tx\n", 100001) {
+		t.Error("hasUID() = true without a Uid line")
+	}
+}
+
+func TestNamePattern(t *testing.T) {
+	for _, name := range []string{"vmlinux", "rootfs-disk.ext4", "1_data"} {
+		if !namePattern.MatchString(name) {
+			t.Errorf("%q is rejected", name)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "../etc", "a/b", ".hidden", "-f"} {
+		if namePattern.MatchString(name) {
+			t.Errorf("%q is accepted", name)
+		}
+	}
+}
+
+func TestFormatACL(t *testing.T) {
+	entries := append(minimalACL(0640), aclEntry{aclUser, 6, 100001}, aclEntry{aclUser, 4, 5})
+	got, err := parseACL(formatACL(entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []aclEntry{
+		{aclUserObj, 6, aclUndefinedID},
+		{aclUser, 4, 5},
+		{aclUser, 6, 100001},
+		{aclGroupObj, 4, aclUndefinedID},
+		{aclMask, 6, aclUndefinedID},
+		{aclOther, 0, aclUndefinedID},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("formatACL() = %v, want %v", got, want)
+	}
+
+	// without named entries there is no mask
+	got, err = parseACL(formatACL(append(minimalACL(0644), aclEntry{aclMask, 7, aclUndefinedID})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, minimalACL(0644)) {
+		t.Errorf("formatACL() = %v, want %v", got, minimalACL(0644))
+	}
+}
+
+func TestParseACLInvalid(t *testing.T) {
+	for _, data := range [][]byte{nil, {1, 0, 0, 0}, {2, 0, 0, 0, 1}} {
+		if _, err := parseACL(data); err == nil {
+			t.Errorf("parseACL(%v) succeeded", data)
+		}
+	}
+}
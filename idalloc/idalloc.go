@@ -0,0 +1,214 @@
+// Package idalloc hands out the unprivileged UID/GID pairs jailed VMs run as,
+// so no two live VMs share an identity on the host.
+package idalloc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+
+	"ranjankuldeep/test/statefile"
+)
+
+var ErrRangeExhausted = errors.New("no free IDs left in range")
+
+// DefaultRange lies above the subordinate ID ranges useradd hands out to the
+// first users of a host.
+var DefaultRange = Range{Start: 10000000, Count: 65536}
+
+// Range is a block of host IDs in the format of /etc/subuid, starting at
+// Start and Count IDs long.
+type Range struct {
+	Start int `json:"start"`
+	Count int `json:"count"`
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%d:%d", r.Start, r.Count)
+}
+
+// Contains reports whether id lies in r.
+func (r Range) Contains(id int) bool {
+	return id >= r.Start && id < r.Start+r.Count
+}
+
+// CurrentRange returns the IDs both /etc/subuid and /etc/subgid delegate to
+// the user running the process. Without root, VMs can only run as those, see
+// package helper.
+func CurrentRange() (Range, error) {
+	u, err := user.Current()
+	if err != nil {
+		return Range{}, err
+	}
+	var ranges [2]Range
+	for i, path := range []string{"/etc/subuid", "/etc/subgid"} {
+		r, err := LookupSubIDRange(path, u.Username)
+		if err != nil {
+			// entries may name the user by ID instead
+			if r, err = LookupSubIDRange(path, u.Uid); err != nil {
+				return Range{}, err
+			}
+		}
+		ranges[i] = r
+	}
+	start := max(ranges[0].Start, ranges[1].Start)
+	end := min(ranges[0].Start+ranges[0].Count, ranges[1].Start+ranges[1].Count)
+	if end <= start {
+		return Range{}, fmt.Errorf("the subordinate UIDs and GIDs of %s do not overlap", u.Username)
+	}
+	return Range{Start: start, Count: end - start}, nil
+}
+
+// LookupSubIDRange returns the range owned by owner in a subuid or subgid
+// file such as /etc/subuid, so VMs can run as subordinate IDs of the user
+// running the controller.
+func LookupSubIDRange(path string, owner string) (Range, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Range{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || fields[0] != owner {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid range start %q in %s: %w", fields[1], path, err)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid range count %q in %s: %w", fields[2], path, err)
+		}
+		return Range{Start: start, Count: count}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return Range{}, err
+	}
+	return Range{}, fmt.Errorf("%s has no range for %s", path, owner)
+}
+
+// Identity is the UID and GID a jailed VM runs as.
+type Identity struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// Allocator picks identities at random from a range and records them in a
+// state file so allocations survive restarts and are shared between
+// processes. A VM gets the same number as UID and GID.
+type Allocator struct {
+	mu    sync.Mutex
+	path  string
+	rng   Range
+	order *rand.Rand
+}
+
+type state struct {
+	Range      Range               `json:"range"`
+	Identities map[string]Identity `json:"identities"`
+}
+
+// New returns an allocator for the range. Root is never handed out.
+func New(path string, r Range) (*Allocator, error) {
+	if r.Start < 1 || r.Count < 1 {
+		return nil, fmt.Errorf("invalid ID range %s", r)
+	}
+	return &Allocator{
+		path:  path,
+		rng:   r,
+		order: rand.New(rand.NewSource(rand.Int63())),
+	}, nil
+}
+
+// Path is the state file of the allocator.
+func (a *Allocator) Path() string {
+	return a.path
+}
+
+// Range is the range the allocator hands identities out from.
+func (a *Allocator) Range() Range {
+	return a.rng
+}
+
+// Allocate returns the identity of the VM, picking a free one if the VM does
+// not hold one yet.
+func (a *Allocator) Allocate(vmID string) (Identity, error) {
+	var id Identity
+	err := a.update(func(s *state) error {
+		if held, ok := s.Identities[vmID]; ok {
+			id = held
+			return nil
+		}
+		used := make(map[int]bool, len(s.Identities))
+		for _, held := range s.Identities {
+			used[held.UID] = true
+		}
+		// probe from a random offset so identities are not predictable
+		offset := a.order.Intn(a.rng.Count)
+		for i := 0; i < a.rng.Count; i++ {
+			n := a.rng.Start + (offset+i)%a.rng.Count
+			if used[n] {
+				continue
+			}
+			id = Identity{UID: n, GID: n}
+			s.Identities[vmID] = id
+			return nil
+		}
+		return ErrRangeExhausted
+	})
+	return id, err
+}
+
+// Lookup returns the identity currently held by the VM.
+func (a *Allocator) Lookup(vmID string) (Identity, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := state{Range: a.rng}
+	if err := statefile.Read(a.path, &s); err != nil {
+		return Identity{}, err
+	}
+	if s.Range != a.rng {
+		return Identity{}, fmt.Errorf("identity state %s belongs to range %s, not %s", a.path, s.Range, a.rng)
+	}
+	id, ok := s.Identities[vmID]
+	if !ok {
+		return Identity{}, fmt.Errorf("no identity found for vm %q", vmID)
+	}
+	return id, nil
+}
+
+// Release returns the VM's identity to the range. Releasing an unknown VM is
+// not an error.
+func (a *Allocator) Release(vmID string) error {
+	return a.update(func(s *state) error {
+		delete(s.Identities, vmID)
+		return nil
+	})
+}
+
+func (a *Allocator) update(fn func(s *state) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := state{Range: a.rng, Identities: map[string]Identity{}}
+	return statefile.Update(a.path, &s, func() error {
+		if s.Range != a.rng {
+			return fmt.Errorf("identity state %s belongs to range %s, not %s", a.path, s.Range, a.rng)
+		}
+		if s.Identities == nil {
+			s.Identities = map[string]Identity{}
+		}
+		return fn(&s)
+	})
+}
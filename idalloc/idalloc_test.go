@@ -0,0 +1,100 @@
+package idalloc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupSubIDRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+	content := "alice:100000:65536\nbob:165536:65536\nbroken:x:1\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		owner   string
+		want    Range
+		wantErr bool
+	}{
+		{owner: "alice", want: Range{Start: 100000, Count: 65536}},
+		{owner: "bob", want: Range{Start: 165536, Count: 65536}},
+		{owner: "broken", wantErr: true},
+		{owner: "carol", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := LookupSubIDRange(path, tt.owner)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LookupSubIDRange(%s) error = %v, wantErr %v", tt.owner, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("LookupSubIDRange(%s) = %s, want %s", tt.owner, got, tt.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []Range{{Start: 0, Count: 10}, {Start: 1000, Count: 0}}
+	for _, r := range tests {
+		if _, err := New(filepath.Join(t.TempDir(), "ids.json"), r); err == nil {
+			t.Errorf("New(%s) succeeded", r)
+		}
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids.json")
+	r := Range{Start: 5000, Count: 3}
+	a, err := New(path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[int]bool{}
+	for _, vm := range []string{"a", "b", "c"} {
+		id, err := a.Allocate(vm)
+		if err != nil {
+			t.Fatalf("Allocate(%s): %v", vm, err)
+		}
+		if id.UID != id.GID || id.UID < r.Start || id.UID >= r.Start+r.Count {
+			t.Errorf("Allocate(%s) = %+v, want UID = GID in %s", vm, id, r)
+		}
+		if seen[id.UID] {
+			t.Errorf("Allocate(%s) = %+v, which is taken", vm, id)
+		}
+		seen[id.UID] = true
+	}
+	if _, err := a.Allocate("d"); !errors.Is(err, ErrRangeExhausted) {
+		t.Errorf("Allocate(d) = %v, want %v", err, ErrRangeExhausted)
+	}
+
+	held, err := a.Lookup("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := a.Allocate("b"); err != nil || again != held {
+		t.Errorf("Allocate(b) = %+v, %v, want the held %+v", again, err, held)
+	}
+
+	if err := a.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Lookup("b"); err == nil {
+		t.Error("Lookup(b) succeeded after Release")
+	}
+	id, err := a.Allocate("d")
+	if err != nil || id != held {
+		t.Errorf("Allocate(d) = %+v, %v, want the released %+v", id, err, held)
+	}
+
+	other, err := New(path, Range{Start: 9000, Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Lookup("d"); err == nil {
+		t.Error("Lookup succeeded on the state of another range")
+	}
+}
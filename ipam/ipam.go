@@ -0,0 +1,298 @@
+package ipam
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+
+	"ranjankuldeep/test/statefile"
+)
+
+var ErrSubnetExhausted = errors.New("no free addresses left in subnet")
+
+// Lease is the network identity handed out to a single VM.
+type Lease struct {
+	ID      string
+	IP      net.IPNet
+	Gateway net.IP
+	MAC     string
+}
+
+// IPConfiguration converts the lease into the static guest configuration
+// firecracker passes to the kernel through the ip= boot argument. The kernel
+// only understands IPv4 there, so IPv6 leases yield nil and IPv6 nameservers
+// are dropped; use GuestConfig to hand those to the guest through MMDS.
+func (l *Lease) IPConfiguration(ifName string, nameservers []string) *firecracker.IPConfiguration {
+	if l.IsIPv6() {
+		return nil
+	}
+	var v4 []string
+	for _, ns := range nameservers {
+		if ip := net.ParseIP(ns); ip != nil && ip.To4() != nil {
+			v4 = append(v4, ns)
+		}
+	}
+	return &firecracker.IPConfiguration{
+		IPAddr:      l.IP,
+		Gateway:     l.Gateway,
+		Nameservers: v4,
+		IfName:      ifName,
+	}
+}
+
+// IsIPv6 reports whether the lease was allocated from an IPv6 subnet.
+func (l *Lease) IsIPv6() bool {
+	return l.IP.IP.To4() == nil
+}
+
+// Subnet returns the network the lease was allocated from.
+func (l *Lease) Subnet() *net.IPNet {
+	return &net.IPNet{IP: l.IP.IP.Mask(l.IP.Mask), Mask: l.IP.Mask}
+}
+
+// Allocator hands out unique addresses from a subnet and records them in a
+// state file so allocations survive restarts and are shared between processes.
+type Allocator struct {
+	mu      sync.Mutex
+	path    string
+	subnet  *net.IPNet
+	gateway net.IP
+}
+
+type state struct {
+	Subnet string            `json:"subnet"`
+	Leases map[string]string `json:"leases"`
+}
+
+// New returns an allocator for the given IPv4 or IPv6 CIDR. The first host
+// address of the subnet is reserved for the gateway. Dual-stack VMs take one
+// lease from an allocator of each family.
+func New(path string, cidr string) (*Allocator, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %w", cidr, err)
+	}
+	if ip := subnet.IP.To4(); ip != nil {
+		subnet.IP = ip
+	}
+	if ones, bits := subnet.Mask.Size(); bits-ones < 2 {
+		return nil, fmt.Errorf("subnet %q is too small to allocate from", cidr)
+	}
+	return &Allocator{
+		path:    path,
+		subnet:  subnet,
+		gateway: nthIP(subnet, 1),
+	}, nil
+}
+
+// Gateway returns the address reserved for the subnet gateway.
+func (a *Allocator) Gateway() net.IP {
+	return a.gateway
+}
+
+// Allocate returns the lease for the VM, assigning a free address if the VM
+// does not hold one yet.
+func (a *Allocator) Allocate(id string) (*Lease, error) {
+	var lease *Lease
+	err := a.update(func(s *state) error {
+		if ip, ok := s.Leases[id]; ok {
+			lease = a.lease(id, net.ParseIP(ip))
+			return nil
+		}
+		used := make(map[string]bool, len(s.Leases))
+		for _, ip := range s.Leases {
+			used[ip] = true
+		}
+		// skip the network and gateway addresses, and for IPv4 the broadcast
+		// address
+		last := a.size() - 1
+		if len(a.subnet.IP) == net.IPv4len {
+			last--
+		}
+		for i := uint64(2); i <= last; i++ {
+			ip := nthIP(a.subnet, i)
+			if used[ip.String()] {
+				continue
+			}
+			s.Leases[id] = ip.String()
+			lease = a.lease(id, ip)
+			return nil
+		}
+		return ErrSubnetExhausted
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Lookup returns the lease currently held by the VM.
+func (a *Allocator) Lookup(id string) (*Lease, error) {
+	s, err := a.read()
+	if err != nil {
+		return nil, err
+	}
+	ip, ok := s.Leases[id]
+	if !ok {
+		return nil, fmt.Errorf("no lease found for vm %q", id)
+	}
+	return a.lease(id, net.ParseIP(ip)), nil
+}
+
+// Release returns the VM's address to the pool. Releasing an unknown VM is
+// not an error.
+func (a *Allocator) Release(id string) error {
+	return a.update(func(s *state) error {
+		delete(s.Leases, id)
+		return nil
+	})
+}
+
+func (a *Allocator) lease(id string, ip net.IP) *Lease {
+	return &Lease{
+		ID:      id,
+		IP:      net.IPNet{IP: ip[len(ip)-len(a.subnet.IP):], Mask: a.subnet.Mask},
+		Gateway: a.gateway,
+		MAC:     MACFromID(id),
+	}
+}
+
+// update loads the state file under an exclusive lock, applies fn and writes
+// the result back.
+func (a *Allocator) update(fn func(s *state) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := state{Subnet: a.subnet.String(), Leases: map[string]string{}}
+	return statefile.Update(a.path, &s, func() error {
+		if s.Subnet != a.subnet.String() {
+			return fmt.Errorf("ipam state %s belongs to subnet %s, not %s", a.path, s.Subnet, a.subnet)
+		}
+		if s.Leases == nil {
+			s.Leases = map[string]string{}
+		}
+		return fn(&s)
+	})
+}
+
+// read loads the state file under a shared lock, without writing it.
+func (a *Allocator) read() (*state, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s := state{Subnet: a.subnet.String()}
+	if err := statefile.Read(a.path, &s); err != nil {
+		return nil, err
+	}
+	if s.Subnet != a.subnet.String() {
+		return nil, fmt.Errorf("ipam state %s belongs to subnet %s, not %s", a.path, s.Subnet, a.subnet)
+	}
+	return &s, nil
+}
+
+// MACFromID derives a stable, locally administered unicast MAC address from
+// the VM ID so a VM keeps the same address across restarts.
+func MACFromID(id string) string {
+	return macFromSeed(id)
+}
+
+// InterfaceMAC derives the MAC address of the VM's index-th NIC, so the NICs
+// of a VM differ. The first NIC gets MACFromID.
+func InterfaceMAC(id string, index int) string {
+	if index == 0 {
+		return MACFromID(id)
+	}
+	return macFromSeed(fmt.Sprintf("%s/%d", id, index))
+}
+
+func macFromSeed(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac.String()
+}
+
+// size is the number of addresses in the subnet, capped for large IPv6
+// subnets where it does not fit a uint64.
+func (a *Allocator) size() uint64 {
+	ones, bits := a.subnet.Mask.Size()
+	if bits-ones >= 64 {
+		return math.MaxUint64
+	}
+	return uint64(1) << uint(bits-ones)
+}
+
+// nthIP returns the n-th address of the subnet, in the subnet's length.
+func nthIP(subnet *net.IPNet, n uint64) net.IP {
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip, subnet.IP)
+	if len(ip) == net.IPv4len {
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+uint32(n))
+		return ip
+	}
+	tail := ip[len(ip)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)+n)
+	return ip
+}
+
+// InterfaceConfig is the complete static configuration of one guest
+// interface. It is published through MMDS for what the kernel ip= argument
+// cannot express, such as IPv6 addresses. Guests must configure it statically
+// and not wait for router advertisements, none are sent on the tap.
+type InterfaceConfig struct {
+	IfName      string   `json:"ifname"`
+	MAC         string   `json:"mac"`
+	MTU         int      `json:"mtu,omitempty"`
+	Addresses   []string `json:"addresses"`
+	Gateways    []string `json:"gateways"`
+	Nameservers []string `json:"nameservers"`
+	Search      []string `json:"search,omitempty"`
+	AcceptRA    bool     `json:"accept_ra"`
+}
+
+// NetworkMetadata is the network document placed in MMDS under "network".
+type NetworkMetadata struct {
+	Interfaces []InterfaceConfig `json:"interfaces"`
+}
+
+// KernelArgs returns the firetest.mtu= kernel argument, e.g.
+// "firetest.mtu=eth0:1450,eth1:1500", for the guest init to apply before the
+// interfaces come up. The kernel ip= argument has no MTU field, and neither
+// the kernel nor stock distributions know this argument, the guest image
+// must bring its own agent reading it from /proc/cmdline.
+func (m NetworkMetadata) KernelArgs() string {
+	var mtus []string
+	for _, iface := range m.Interfaces {
+		if iface.MTU != 0 {
+			mtus = append(mtus, fmt.Sprintf("%s:%d", iface.IfName, iface.MTU))
+		}
+	}
+	if len(mtus) == 0 {
+		return ""
+	}
+	return "firetest.mtu=" + strings.Join(mtus, ",")
+}
+
+// GuestConfig combines the leases of one interface, usually an IPv4 and an
+// IPv6 lease of the same VM, into its static configuration.
+func GuestConfig(ifName string, nameservers []string, leases ...*Lease) InterfaceConfig {
+	cfg := InterfaceConfig{
+		IfName:      ifName,
+		Addresses:   []string{},
+		Gateways:    []string{},
+		Nameservers: nameservers,
+	}
+	for _, lease := range leases {
+		cfg.MAC = lease.MAC
+		cfg.Addresses = append(cfg.Addresses, lease.IP.String())
+		cfg.Gateways = append(cfg.Gateways, lease.Gateway.String())
+	}
+	return cfg
+}
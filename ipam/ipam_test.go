@@ -0,0 +1,169 @@
+package ipam
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNthIP(t *testing.T) {
+	tests := []struct {
+		cidr string
+		n    uint64
+		want string
+	}{
+		{"10.0.0.0/24", 0, "10.0.0.0"},
+		{"10.0.0.0/24", 1, "10.0.0.1"},
+		{"10.0.0.0/16", 256, "10.0.1.0"},
+		{"fd00::/64", 1, "fd00::1"},
+		{"fd00::/64", 1 << 32, "fd00::1:0:0"},
+	}
+	for _, tt := range tests {
+		_, subnet, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := subnet.IP.To4(); ip != nil {
+			subnet.IP = ip
+		}
+		got := nthIP(subnet, tt.n)
+		if got.String() != tt.want {
+			t.Errorf("nthIP(%s, %d) = %s, want %s", tt.cidr, tt.n, got, tt.want)
+		}
+		if len(got) != len(subnet.IP) {
+			t.Errorf("nthIP(%s, %d) has length %d, want %d", tt.cidr, tt.n, len(got), len(subnet.IP))
+		}
+	}
+}
+
+func TestMACFromID(t *testing.T) {
+	tests := []string{"vm-1", "vm-2", ""}
+	for _, id := range tests {
+		mac := MACFromID(id)
+		if again := MACFromID(id); again != mac {
+			t.Errorf("MACFromID(%q) = %s, then %s", id, mac, again)
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatalf("MACFromID(%q) = %q: %v", id, mac, err)
+		}
+		if hw[0]&0x02 == 0 || hw[0]&0x01 != 0 {
+			t.Errorf("MACFromID(%q) = %s is not a locally administered unicast address", id, mac)
+		}
+		if InterfaceMAC(id, 0) != mac {
+			t.Errorf("InterfaceMAC(%q, 0) = %s, want %s", id, InterfaceMAC(id, 0), mac)
+		}
+		if InterfaceMAC(id, 1) == mac {
+			t.Errorf("InterfaceMAC(%q, 1) equals the first NIC's %s", id, mac)
+		}
+	}
+	if MACFromID("vm-1") == MACFromID("vm-2") {
+		t.Error("different VMs got the same MAC")
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	a, err := New(path, "10.0.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Gateway().String() != "10.0.0.1" {
+		t.Errorf("Gateway() = %s, want 10.0.0.1", a.Gateway())
+	}
+
+	// .2 to .6, .7 is the broadcast address
+	var ips []string
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		lease, err := a.Allocate(id)
+		if err != nil {
+			t.Fatalf("Allocate(%s): %v", id, err)
+		}
+		ips = append(ips, lease.IP.String())
+	}
+	want := []string{"10.0.0.2/29", "10.0.0.3/29", "10.0.0.4/29", "10.0.0.5/29", "10.0.0.6/29"}
+	for i := range want {
+		if ips[i] != want[i] {
+			t.Errorf("lease %d = %s, want %s", i, ips[i], want[i])
+		}
+	}
+	if _, err := a.Allocate("f"); !errors.Is(err, ErrSubnetExhausted) {
+		t.Errorf("Allocate(f) = %v, want %v", err, ErrSubnetExhausted)
+	}
+
+	// allocating again returns the held lease
+	lease, err := a.Allocate("c")
+	if err != nil || lease.IP.String() != "10.0.0.4/29" {
+		t.Errorf("Allocate(c) = %v, %v, want 10.0.0.4/29", lease, err)
+	}
+
+	if err := a.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Lookup("b"); err == nil {
+		t.Error("Lookup(b) succeeded after Release")
+	}
+	lease, err = a.Allocate("f")
+	if err != nil || lease.IP.String() != "10.0.0.3/29" {
+		t.Errorf("Allocate(f) = %v, %v, want the released 10.0.0.3/29", lease, err)
+	}
+
+	// another allocator on the same file sees the leases
+	b, err := New(path, "10.0.0.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err = b.Lookup("f")
+	if err != nil || lease.IP.String() != "10.0.0.3/29" || lease.MAC != MACFromID("f") {
+		t.Errorf("Lookup(f) = %v, %v, want 10.0.0.3/29", lease, err)
+	}
+
+	other, err := New(path, "10.1.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Lookup("f"); err == nil {
+		t.Error("Lookup succeeded on the state of another subnet")
+	}
+}
+
+func TestLookupDoesNotWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ipam.json")
+	a, err := New(path, "fd00::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Lookup("a"); err == nil {
+		t.Error("Lookup(a) succeeded on a fresh state")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Lookup created the state file: %v", err)
+	}
+
+	lease, err := a.Allocate("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.IP.String() != "fd00::2/64" || !lease.IsIPv6() || lease.IPConfiguration("eth0", nil) != nil {
+		t.Errorf("Allocate(a) = %v, want fd00::2/64 without a kernel configuration", lease)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Lookup("a"); err != nil {
+		t.Errorf("Lookup(a) on a read-only state: %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(before.ModTime()) {
+		t.Error("Lookup rewrote the state file")
+	}
+}
@@ -1,45 +1,59 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"os"
-	"ranjankuldeep/test/snapshot"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"ranjankuldeep/test/idalloc"
+	"ranjankuldeep/test/methods"
+	"ranjankuldeep/test/vmid"
 )
 
 func main() {
-	baseFile := "../ubuntu-22.04.ext4"
-	overlayDir := "../overlays"
-	uid := 123
-	gid := 100
+	// without root, VMs can only run as the IDs delegated to this user
+	idRange := idalloc.DefaultRange
+	if os.Geteuid() != 0 {
+		r, err := idalloc.CurrentRange()
+		if err != nil {
+			log.Fatalf("Failed to find the subordinate IDs of this user: %v", err)
+		}
+		idRange = r
+	}
+	identities, err := idalloc.New(methods.IdentityStateFile, idRange)
+	if err != nil {
+		log.Fatalf("Failed to open identity allocator: %v", err)
+	}
 
-	device, err := snapshot.CreateDeviceMapper(baseFile, overlayDir)
+	ctx := context.Background()
+	vm, err := methods.LaunchJailedVM(ctx, methods.Spec{
+		ID:              vmid.New(),
+		Identities:      identities,
+		KernelImagePath: "vmlinux-5.10.210",
+		RootImage:       "../ubuntu-22.04.ext4",
+		OverlayDir:      "../overlays",
+	})
 	if err != nil {
-		log.Fatalf("Failed to create device mapper: %v", err)
+		log.Fatalf("Failed to launch VM: %v", err)
 	}
-	defer func() {
-		if err := device.Cleanup(); err != nil {
-			log.Fatalf("Failed to cleanup device mapper: %v", err)
+	log.Printf("VM %s is running, API socket at %s", vm.ID, vm.Socket())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stopCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		if err := vm.Stop(stopCtx); err != nil {
+			log.Printf("Failed to stop VM %s: %v", vm.ID, err)
 		}
 	}()
 
-	if err := os.Chown(device.OverlayFilename, uid, gid); err != nil {
-		log.Fatalf("Failed to change ownership of overlay file: %v", err)
+	// the overlay device and the rest of the VM are released once it exits
+	if err := vm.Wait(ctx); err != nil {
+		log.Fatalf("VM %s exited: %v", vm.ID, err)
 	}
-
-	fmt.Printf("Ownership of overlay file %s changed to UID: %d and GID: %d\n", device.OverlayFilename, uid, gid)
-
-	fmt.Printf("Device Mapper created:\n")
-	fmt.Printf("Base Device: %s\n", device.BaseDev.Path())
-	fmt.Printf("Overlay Device: %s\n", device.OverlayDev.Path())
-	fmt.Printf("Base Name: %s\n", device.BaseName)
-	fmt.Printf("Overlay Name: %s\n", device.OverlayName)
-	fmt.Printf("Overlay Filename: %s\n", device.OverlayFilename)
-
-	// The overlay device you will pass to Firecracker
-	overlayDevicePath := fmt.Sprintf("/dev/mapper/%s", device.OverlayName)
-	fmt.Printf("Overlay Device Path: %s\n", overlayDevicePath)
-
-	// methods.ExampleJailerConfig_enablingJailer()
-	select {}
 }
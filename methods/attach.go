@@ -0,0 +1,241 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/sirupsen/logrus"
+	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/helper"
+	"ranjankuldeep/test/idalloc"
+	"ranjankuldeep/test/snapshot"
+	"ranjankuldeep/test/statefile"
+	"ranjankuldeep/test/vmid"
+)
+
+const (
+	// VMStateFile records the running VMs so a restarted controller can find
+	// them again with Attach.
+	VMStateFile = "/var/lib/firetest/vms.json"
+	// PIDDir keeps the PID files of the VMMs, outside of their chroots,
+	// which the jailed users can write to.
+	PIDDir = "/var/lib/firetest/pids"
+)
+
+var (
+	ErrVMNotFound = errors.New("VM not found")
+	ErrVMExists   = errors.New("VM already exists")
+)
+
+// Record is what a controller needs to reattach to a running VM and release
+// its resources once it exits.
+type Record struct {
+	ID      vmid.ID `json:"id"`
+	PID     int     `json:"pid"`
+	PIDFile string  `json:"pid_file"`
+	Socket  string  `json:"socket"`
+
+	ChrootBaseDir     string `json:"chroot_base_dir"`
+	FirecrackerBinary string `json:"firecracker_binary"`
+	// UID and GID the VMM runs as.
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+
+	NetNS   string              `json:"netns,omitempty"`
+	Network []NetworkAttachment `json:"network,omitempty"`
+
+	// OverlayDir and Loops identify the root drive snapshot, if any.
+	OverlayDir string   `json:"overlay_dir,omitempty"`
+	Loops      []string `json:"loops,omitempty"`
+
+	// IdentityState and IdentityRange identify the allocator the VM's
+	// identity came from, if any.
+	IdentityState string        `json:"identity_state,omitempty"`
+	IdentityRange idalloc.Range `json:"identity_range"`
+}
+
+func (r Record) jailerConfig() *firecracker.JailerConfig {
+	return &firecracker.JailerConfig{
+		ID:            r.ID.String(),
+		ChrootBaseDir: r.ChrootBaseDir,
+		ExecFile:      r.FirecrackerBinary,
+		UID:           firecracker.Int(r.UID),
+		GID:           firecracker.Int(r.GID),
+	}
+}
+
+// pidFile is where the VMM's PID is kept.
+func pidFile(id vmid.ID) string {
+	return filepath.Join(PIDDir, id.String()+".pid")
+}
+
+func updateRecords(fn func(records map[vmid.ID]Record) error) error {
+	records := map[vmid.ID]Record{}
+	return statefile.Update(VMStateFile, &records, func() error {
+		if records == nil {
+			records = map[vmid.ID]Record{}
+		}
+		return fn(records)
+	})
+}
+
+func saveRecord(r Record) error {
+	return updateRecords(func(records map[vmid.ID]Record) error {
+		records[r.ID] = r
+		return nil
+	})
+}
+
+// claimRecord records r unless a VM with the same ID is recorded already,
+// which makes the ID this launch's.
+func claimRecord(r Record) error {
+	return updateRecords(func(records map[vmid.ID]Record) error {
+		if _, ok := records[r.ID]; ok {
+			return fmt.Errorf("%w: %s", ErrVMExists, r.ID)
+		}
+		records[r.ID] = r
+		return nil
+	})
+}
+
+// removeRecord forgets the VM, and its PID file.
+func removeRecord(id vmid.ID) error {
+	if err := os.Remove(pidFile(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return updateRecords(func(records map[vmid.ID]Record) error {
+		delete(records, id)
+		return nil
+	})
+}
+
+// LookupRecord returns the record of a VM started by LaunchJailedVM.
+func LookupRecord(id vmid.ID) (Record, error) {
+	records := map[vmid.ID]Record{}
+	if err := statefile.Read(VMStateFile, &records); err != nil {
+		return Record{}, err
+	}
+	r, ok := records[id]
+	if !ok {
+		return Record{}, fmt.Errorf("%w: %s", ErrVMNotFound, id)
+	}
+	return r, nil
+}
+
+// Attach returns a handle to a VM started by LaunchJailedVM in an earlier
+// process, talking to its VMM through the API socket. It restarts the
+// network services that ran in that process, and releases the VM's
+// resources once its VMM exits, like the handle LaunchJailedVM returned.
+// VMs started with Spec.Daemonize survive the exit of the process that
+// launched them.
+func Attach(ctx context.Context, id vmid.ID) (*VM, error) {
+	rec, err := LookupRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := readPIDFile(rec.PIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find VMM of VM %s: %w", id, err)
+	}
+	// pidfd refers to this very process even if the PID is reused later on
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return nil, fmt.Errorf("VMM %d of VM %s is not running: %w", pid, id, err)
+	}
+
+	m, err := firecracker.NewMachine(ctx, firecracker.Config{SocketPath: rec.Socket},
+		firecracker.WithLogger(logrus.NewEntry(logs.Logger.Logger)))
+	if err != nil {
+		unix.Close(pidfd)
+		return nil, fmt.Errorf("failed to attach to VM %s: %w", id, err)
+	}
+	if _, err := m.GetFirecrackerVersion(ctx); err != nil {
+		unix.Close(pidfd)
+		return nil, fmt.Errorf("VMM of VM %s does not answer on %s: %w", id, rec.Socket, err)
+	}
+
+	if len(rec.Network) > 0 {
+		if err := ResumeSandBoxNetwork(rec.NetNS, rec.Network); err != nil {
+			unix.Close(pidfd)
+			return nil, fmt.Errorf("failed to resume network of VM %s: %w", id, err)
+		}
+	}
+
+	vm := &VM{ID: id, machine: m, pid: pid, cgroup: jailerCgroup(rec.jailerConfig()), exited: make(chan struct{})}
+	vm.addOnExit(func() error {
+		return removeRecord(id)
+	})
+	vm.addOnExit(func() error {
+		return helper.Release(id)
+	})
+	if rec.IdentityState != "" {
+		vm.addOnExit(func() error {
+			identities, err := idalloc.New(rec.IdentityState, rec.IdentityRange)
+			if err != nil {
+				return err
+			}
+			return identities.Release(id.String())
+		})
+	}
+	if len(rec.Loops) > 0 {
+		vm.addOnExit(func() error {
+			return snapshot.RemoveDevice(id, rec.OverlayDir, rec.Loops)
+		})
+	}
+	if len(rec.Network) > 0 {
+		vm.addOnExit(func() error {
+			return TearDownSandBoxNetwork(rec.NetNS, rec.Network)
+		})
+	}
+	vm.addOnExit(func() error {
+		return CleanUpChroot(rec.jailerConfig())
+	})
+	logs.Logger.Infof("Attached to VM %s, VMM %d", id, pid)
+
+	go func() {
+		defer unix.Close(pidfd)
+		vm.exitErr = waitPidfd(pidfd)
+		vm.exit()
+	}()
+	return vm, nil
+}
+
+func writePIDFile(path string, pid int) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid PID file %s: %w", path, err)
+	}
+	return pid, nil
+}
+
+// waitPidfd blocks until the process exits. Its exit status is only known to
+// its parent, the process that launched it.
+func waitPidfd(pidfd int) error {
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		return err
+	}
+}
@@ -0,0 +1,308 @@
+package methods
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/helper"
+)
+
+// DefaultCPUPeriod is the cpu.max period CPUQuota is applied to.
+const DefaultCPUPeriod = 100 * time.Millisecond
+
+// Resources are the cgroup v2 limits of a VM. Zero values leave a limit
+// unset. The limits cover the whole VMM, the guest memory and vCPUs as well
+// as Firecracker's own threads.
+type Resources struct {
+	// CPUQuota is the number of CPUs the VM may use per CPUPeriod, e.g. 1.5.
+	CPUQuota  float64
+	CPUPeriod time.Duration
+	// CPUWeight is the relative share of CPU time under contention, from 1
+	// to 10000. The kernel default is 100.
+	CPUWeight int
+	// MemoryMax in bytes, it has to leave room for the VMM on top of the
+	// guest memory.
+	MemoryMax int64
+	IOMax     []IOLimit
+	PidsMax   int
+}
+
+// IOLimit limits the I/O of the VMM on a block device.
+type IOLimit struct {
+	// Device is a block device path such as the root drive's
+	// /dev/mapper/overlay-<id>, or its "major:minor" numbers.
+	Device              string
+	ReadBPS, WriteBPS   uint64
+	ReadIOPS, WriteIOPS uint64
+}
+
+func (r Resources) validate(memSizeMib int64) error {
+	if r.CPUQuota < 0 {
+		return fmt.Errorf("invalid CPU quota %v", r.CPUQuota)
+	}
+	if r.CPUQuota > 0 {
+		// cpu.max rejects periods outside 1ms to 1s and quotas below 1ms
+		period := r.cpuPeriod()
+		if period < time.Millisecond || period > time.Second {
+			return fmt.Errorf("CPU period %v is not between 1ms and 1s", period)
+		}
+		if quota := r.cpuQuota(); quota < time.Millisecond {
+			return fmt.Errorf("CPU quota %v of a %v period is %v, below the minimum of 1ms", r.CPUQuota, period, quota)
+		}
+	}
+	if r.CPUWeight != 0 && (r.CPUWeight < 1 || r.CPUWeight > 10000) {
+		return fmt.Errorf("CPU weight %d is not between 1 and 10000", r.CPUWeight)
+	}
+	if r.MemoryMax != 0 && r.MemoryMax <= memSizeMib<<20 {
+		return fmt.Errorf("memory limit of %d bytes does not fit the guest memory of %d MiB", r.MemoryMax, memSizeMib)
+	}
+	return nil
+}
+
+func (r Resources) cpuPeriod() time.Duration {
+	if r.CPUPeriod == 0 {
+		return DefaultCPUPeriod
+	}
+	return r.CPUPeriod
+}
+
+// cpuQuota is the CPU time the VM may use per period.
+func (r Resources) cpuQuota() time.Duration {
+	return time.Duration(r.CPUQuota * float64(r.cpuPeriod()))
+}
+
+// cgroupArgs translates the limits into the jailer's --cgroup arguments.
+func (r Resources) cgroupArgs() ([]string, error) {
+	var args []string
+	add := func(file, value string) {
+		args = append(args, "--cgroup", file+"="+value)
+	}
+	if r.CPUQuota > 0 {
+		add("cpu.max", fmt.Sprintf("%d %d", r.cpuQuota().Microseconds(), r.cpuPeriod().Microseconds()))
+	}
+	if r.CPUWeight > 0 {
+		add("cpu.weight", strconv.Itoa(r.CPUWeight))
+	}
+	if r.MemoryMax > 0 {
+		add("memory.max", strconv.FormatInt(r.MemoryMax, 10))
+	}
+	for _, limit := range r.IOMax {
+		device, err := deviceNumbers(limit.Device)
+		if err != nil {
+			return nil, err
+		}
+		value := device
+		for _, l := range []struct {
+			key   string
+			value uint64
+		}{
+			{"rbps", limit.ReadBPS},
+			{"wbps", limit.WriteBPS},
+			{"riops", limit.ReadIOPS},
+			{"wiops", limit.WriteIOPS},
+		} {
+			if l.value > 0 {
+				value += fmt.Sprintf(" %s=%d", l.key, l.value)
+			}
+		}
+		add("io.max", value)
+	}
+	if r.PidsMax > 0 {
+		add("pids.max", strconv.Itoa(r.PidsMax))
+	}
+	return args, nil
+}
+
+// deviceNumbers returns the "major:minor" numbers of a block device.
+func deviceNumbers(device string) (string, error) {
+	if !strings.HasPrefix(device, "/") {
+		return device, nil
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		return "", &os.PathError{Op: "stat", Path: device, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", device)
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+}
+
+// jailerCommand builds the jailer command the SDK would, plus cgroupArgs,
+// which its JailerConfig has no field for. It is passed to NewMachine with
+// WithProcessRunner.
+func jailerCommand(ctx context.Context, cfg firecracker.Config, cgroupArgs []string) *exec.Cmd {
+	jailer := cfg.JailerCfg
+	fcArgs := []string{}
+	if !cfg.Seccomp.Enabled {
+		fcArgs = append(fcArgs, "--no-seccomp")
+	} else if cfg.Seccomp.Filter != "" {
+		fcArgs = append(fcArgs, "--seccomp-filter", cfg.Seccomp.Filter)
+	}
+	fcArgs = append(fcArgs, "--api-sock", cfg.SocketPath)
+
+	builder := firecracker.NewJailerCommandBuilder().
+		WithID(jailer.ID).
+		WithUID(firecracker.IntValue(jailer.UID)).
+		WithGID(firecracker.IntValue(jailer.GID)).
+		WithNumaNode(firecracker.IntValue(jailer.NumaNode)).
+		WithExecFile(jailer.ExecFile).
+		WithChrootBaseDir(jailer.ChrootBaseDir).
+		WithDaemonize(jailer.Daemonize).
+		WithCgroupVersion(jailer.CgroupVersion).
+		WithFirecrackerArgs(fcArgs...).
+		WithBin(jailer.JailerBinary)
+	if cfg.NetNS != "" {
+		builder = builder.WithNetNS(cfg.NetNS)
+	}
+	// nil stdio is /dev/null, as for daemonized VMMs
+	if jailer.Stdin != nil {
+		builder = builder.WithStdin(jailer.Stdin)
+	}
+	if jailer.Stdout != nil {
+		builder = builder.WithStdout(jailer.Stdout)
+	}
+	if jailer.Stderr != nil {
+		builder = builder.WithStderr(jailer.Stderr)
+	}
+	cmd := builder.Build(ctx)
+
+	// jailer arguments go before the "--" separating Firecracker's
+	for i, arg := range cmd.Args {
+		if arg == "--" {
+			cmd.Args = append(append(append([]string{}, cmd.Args[:i]...), cgroupArgs...), cmd.Args[i:]...)
+			break
+		}
+	}
+	// the jailer starts as root, through the privileged helper unless this
+	// process is root
+	return helper.JailerCommand(ctx, cmd)
+}
+
+// Usage is the resource usage of a VM's cgroup. Memory, Pids and IO are only
+// reported when their controllers are enabled for the cgroup, they are zero
+// otherwise.
+type Usage struct {
+	CPU, CPUUser, CPUSystem time.Duration
+	// Throttled is the time the VM was held back by its CPU quota.
+	Throttled   time.Duration
+	NrThrottled uint64
+	// Memory is the memory charged to the VM in bytes.
+	Memory uint64
+	Pids   uint64
+	// IO is keyed by the "major:minor" numbers of the block devices.
+	IO map[string]IOStat
+}
+
+// IOStat is the I/O of a VM on one block device.
+type IOStat struct {
+	ReadBytes, WriteBytes uint64
+	ReadOps, WriteOps     uint64
+}
+
+// Usage reads the current resource usage from the VM's cgroup.
+func (vm *VM) Usage() (Usage, error) {
+	return readUsage(vm.cgroup)
+}
+
+func readUsage(cgroup string) (Usage, error) {
+	var u Usage
+	cpu, err := readKeyedFile(filepath.Join(cgroup, "cpu.stat"))
+	if err != nil {
+		return Usage{}, err
+	}
+	u.CPU = time.Duration(cpu["usage_usec"]) * time.Microsecond
+	u.CPUUser = time.Duration(cpu["user_usec"]) * time.Microsecond
+	u.CPUSystem = time.Duration(cpu["system_usec"]) * time.Microsecond
+	u.Throttled = time.Duration(cpu["throttled_usec"]) * time.Microsecond
+	u.NrThrottled = cpu["nr_throttled"]
+
+	// the files of a controller only exist while it is enabled in the
+	// parent's cgroup.subtree_control
+	if u.Memory, err = readUintFile(filepath.Join(cgroup, "memory.current")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Usage{}, err
+	}
+	if u.Pids, err = readUintFile(filepath.Join(cgroup, "pids.current")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Usage{}, err
+	}
+
+	// io.stat has a line per device: "8:0 rbytes=1 wbytes=2 rios=3 wios=4 ..."
+	data, err := os.ReadFile(filepath.Join(cgroup, "io.stat"))
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return Usage{}, err
+	}
+	u.IO = map[string]IOStat{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var stat IOStat
+		for _, field := range fields[1:] {
+			key, value, _ := strings.Cut(field, "=")
+			n, _ := strconv.ParseUint(value, 10, 64)
+			switch key {
+			case "rbytes":
+				stat.ReadBytes = n
+			case "wbytes":
+				stat.WriteBytes = n
+			case "rios":
+				stat.ReadOps = n
+			case "wios":
+				stat.WriteOps = n
+			}
+		}
+		u.IO[fields[0]] = stat
+	}
+	return u, nil
+}
+
+// readKeyedFile parses a cgroup file of "key value" lines.
+func readKeyedFile(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q in %s: %w", fields[1], path, err)
+		}
+		values[fields[0]] = n
+	}
+	return values, scanner.Err()
+}
+
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value in %s: %w", path, err)
+	}
+	return n, nil
+}
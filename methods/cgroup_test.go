@@ -0,0 +1,180 @@
+package methods
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+func TestCgroupArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		res  Resources
+		want []string
+	}{
+		{name: "no limits"},
+		{
+			name: "default period",
+			res:  Resources{CPUQuota: 1.5},
+			want: []string{"--cgroup", "cpu.max=150000 100000"},
+		},
+		{
+			name: "all limits",
+			res: Resources{
+				CPUQuota:  0.5,
+				CPUPeriod: 50 * time.Millisecond,
+				CPUWeight: 200,
+				MemoryMax: 1 << 30,
+				IOMax:     []IOLimit{{Device: "8:0", ReadBPS: 1024, WriteIOPS: 10}},
+				PidsMax:   64,
+			},
+			want: []string{
+				"--cgroup", "cpu.max=25000 50000",
+				"--cgroup", "cpu.weight=200",
+				"--cgroup", "memory.max=1073741824",
+				"--cgroup", "io.max=8:0 rbps=1024 wiops=10",
+				"--cgroup", "pids.max=64",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.res.cgroupArgs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cgroupArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (Resources{IOMax: []IOLimit{{Device: os.DevNull}}}).cgroupArgs(); err == nil {
+		t.Errorf("cgroupArgs() accepted the character device %s", os.DevNull)
+	}
+}
+
+func TestResourcesValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		res   Resources
+		valid bool
+	}{
+		{"no limits", Resources{}, true},
+		{"negative quota", Resources{CPUQuota: -1}, false},
+		{"quota below 1ms", Resources{CPUQuota: 0.005}, false},
+		{"quota of 1ms", Resources{CPUQuota: 0.01}, true},
+		{"period too short", Resources{CPUQuota: 1, CPUPeriod: time.Microsecond}, false},
+		{"period too long", Resources{CPUQuota: 1, CPUPeriod: 2 * time.Second}, false},
+		{"weight too high", Resources{CPUWeight: 10001}, false},
+		{"memory below guest", Resources{MemoryMax: 128 << 20}, false},
+		{"memory above guest", Resources{MemoryMax: 256 << 20}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.res.validate(128); (err == nil) != tt.valid {
+			t.Errorf("%s: validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestJailerCommandCgroupArgs(t *testing.T) {
+	cfg := firecracker.Config{
+		SocketPath: "api.sock",
+		JailerCfg: &firecracker.JailerConfig{
+			ID:            "vm-1",
+			UID:           firecracker.Int(10000),
+			GID:           firecracker.Int(10000),
+			NumaNode:      firecracker.Int(0),
+			ExecFile:      "/usr/bin/firecracker",
+			JailerBinary:  "/usr/bin/jailer",
+			ChrootBaseDir: "/srv/jailer",
+			CgroupVersion: "2",
+		},
+	}
+	cgroupArgs := []string{"--cgroup", "pids.max=64"}
+	cmd := jailerCommand(context.Background(), cfg, cgroupArgs)
+
+	sep := -1
+	for i, arg := range cmd.Args {
+		if arg == "--" {
+			sep = i
+			break
+		}
+	}
+	if sep < len(cgroupArgs) {
+		t.Fatalf("jailer command %q has no firecracker arguments after the cgroup arguments", cmd.Args)
+	}
+	if got := cmd.Args[sep-len(cgroupArgs) : sep]; !reflect.DeepEqual(got, cgroupArgs) {
+		t.Errorf("arguments before -- = %q, want %q", got, cgroupArgs)
+	}
+	if got := cmd.Args[sep+1:]; !reflect.DeepEqual(got, []string{"--no-seccomp", "--api-sock", "api.sock"}) {
+		t.Errorf("firecracker arguments = %q", got)
+	}
+}
+
+func TestReadUsage(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  Usage
+	}{
+		{
+			name: "all controllers",
+			files: map[string]string{
+				"cpu.stat":       "usage_usec 3000\nuser_usec 2000\nsystem_usec 1000\nnr_periods 5\nnr_throttled 2\nthrottled_usec 500\n",
+				"memory.current": "4096\n",
+				"pids.current":   "3\n",
+				"io.stat":        "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0\n253:1 rbytes=10 wbytes=20 rios=30 wios=40\n",
+			},
+			want: Usage{
+				CPU:         3 * time.Millisecond,
+				CPUUser:     2 * time.Millisecond,
+				CPUSystem:   time.Millisecond,
+				Throttled:   500 * time.Microsecond,
+				NrThrottled: 2,
+				Memory:      4096,
+				Pids:        3,
+				IO: map[string]IOStat{
+					"8:0":   {ReadBytes: 1, WriteBytes: 2, ReadOps: 3, WriteOps: 4},
+					"253:1": {ReadBytes: 10, WriteBytes: 20, ReadOps: 30, WriteOps: 40},
+				},
+			},
+		},
+		{
+			name:  "only cpu",
+			files: map[string]string{"cpu.stat": "usage_usec 1\n"},
+			want:  Usage{CPU: time.Microsecond},
+		},
+		{
+			name:  "no io yet",
+			files: map[string]string{"cpu.stat": "usage_usec 1\n", "io.stat": ""},
+			want:  Usage{CPU: time.Microsecond, IO: map[string]IOStat{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := readUsage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readUsage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readUsage(t.TempDir()); err == nil {
+		t.Error("readUsage() succeeded without cpu.stat")
+	}
+}
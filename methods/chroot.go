@@ -0,0 +1,64 @@
+package methods
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/weaveworks/ignite/pkg/logs"
+
+	"ranjankuldeep/test/helper"
+	"ranjankuldeep/test/vmid"
+)
+
+// CgroupRoot is where the unified cgroup v2 hierarchy is mounted.
+const CgroupRoot = helper.CgroupRoot
+
+// LeftoverError lists the resources of a VM that could not be removed.
+type LeftoverError struct {
+	ID        string
+	Resources []string
+}
+
+func (e *LeftoverError) Error() string {
+	return fmt.Sprintf("VM %s left behind: %s", e.ID, strings.Join(e.Resources, ", "))
+}
+
+// chrootDir is the directory the jailer creates for the VM, the parent of
+// chrootRootFS.
+func chrootDir(cfg *firecracker.JailerConfig) string {
+	return vmid.ID(cfg.ID).ChrootDir(cfg.ChrootBaseDir, cfg.ExecFile)
+}
+
+// chrootRootFS is the host path of the directory the jailer chroots into.
+func chrootRootFS(cfg *firecracker.JailerConfig) string {
+	return filepath.Join(chrootDir(cfg), rootfsFolderName)
+}
+
+// jailerCgroup is the cgroup the jailer moves the VMM into. Its parent
+// defaults to the name of the jailed binary.
+func jailerCgroup(cfg *firecracker.JailerConfig) string {
+	return filepath.Join(CgroupRoot, filepath.Base(cfg.ExecFile), cfg.ID)
+}
+
+// CleanUpChroot removes what the jailer left on the host once the VMM
+// exited: it unmounts everything mounted below the chroot, removes the
+// chroot tree and the VM's cgroup, and revokes the access to the shared
+// kernel and drives the VM's identity was granted. Resources that are still there afterwards
+// are reported as a *LeftoverError.
+func CleanUpChroot(cfg *firecracker.JailerConfig) error {
+	dir := chrootDir(cfg)
+	leftovers, err := helper.RemoveChroot(dir, jailerCgroup(cfg), firecracker.IntValue(cfg.UID))
+	if len(leftovers) > 0 {
+		if err != nil {
+			logs.Logger.Errorf("Failed to clean up chroot of VM %s: %v", cfg.ID, err)
+		}
+		return &LeftoverError{ID: cfg.ID, Resources: leftovers}
+	}
+	if err != nil {
+		return err
+	}
+	logs.Logger.Infof("Removed chroot %s", dir)
+	return nil
+}
@@ -3,7 +3,8 @@ package methods
 import (
 	"context"
 	"fmt"
-	"log"
+	"net"
+	"os"
 	"os/exec"
 	"strings"
 
@@ -11,53 +12,83 @@ import (
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/weaveworks/ignite/pkg/logs"
+
+	"ranjankuldeep/test/netlink"
 )
 
-func CreateContainer(name string) (string, error) {
-	options := network.CreateOptions{
-		Driver: "bridge",
-		Labels: map[string]string{
-			"mylabel": "value",
-		},
-		IPAM: &network.IPAM{
-			Config: []network.IPAMConfig{
-				{
-					Subnet:  "172.16.0.0/24",
-					Gateway: "172.16.0.1",
-				},
-			},
-		},
-		Options: map[string]string{},
+const (
+	// SandboxSubnet is the docker network the sandbox containers, and the VMs
+	// behind them, get their addresses from.
+	SandboxSubnet  = "172.16.0.0/24"
+	SandboxSubnet6 = "fd00:fc::/64"
+	IPAMStateFile  = "/var/lib/firetest/ipam.json"
+	IPAMStateFile6 = "/var/lib/firetest/ipam6.json"
+	// SandboxLabel marks the docker networks created for sandboxes, others
+	// of the same name are not reused.
+	SandboxLabel = "firetest.sandbox"
+)
+
+// CreateContainer starts the sandbox container whose network namespace hosts
+// the VM's tap devices. It joins a docker network per attachment and sets
+// the SourceIface of attachments that have none to the container interface
+// of the attachment's endpoint, found by the MAC and addresses docker reports
+// for it, as docker does not number the interfaces in a defined order. Each
+// endpoint is pinned to the attachment's addresses and MAC so the guest,
+// which takes them over through the tc redirect, is reachable. Attaching an
+// IPv4 and an IPv6 lease gives a dual-stack NIC, a single IPv6 lease an
+// IPv6-only one.
+func CreateContainer(name string, attachments []NetworkAttachment) (string, error) {
+	if len(attachments) == 0 {
+		return "", fmt.Errorf("container %s needs at least one network attachment", name)
 	}
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		logs.Logger.Errorf("Failed to create Docker client: %v", err)
 		return "", err
 	}
-	networkName := "testJailer"
-	networkResp, err := cli.NetworkCreate(context.Background(), networkName, options)
-	if err != nil {
-		log.Fatalf("Failed to create network: %v", err)
-		return "", err
+
+	networkNames := make([]string, len(attachments))
+	endpoints := make([]*network.EndpointSettings, len(attachments))
+	for i, attachment := range attachments {
+		a := attachment.withDefaults(i)
+		if len(a.Leases) == 0 {
+			return "", fmt.Errorf("attachment %s of container %s needs at least one lease", a.Name, name)
+		}
+		networkName, options, endpoint := sandboxNetwork(a)
+		networkID, err := ensureNetwork(cli, networkName, options)
+		if err != nil {
+			logs.Logger.Errorf("Failed to create network: %v", err)
+			return "", err
+		}
+		endpoint.NetworkID = networkID
+		networkNames[i], endpoints[i] = networkName, endpoint
 	}
-	logs.Logger.Infof("Created network: %s\n", networkName)
 
 	containerName := name
 	containerConfig := &container.Config{
 		Image: "alpine",
 		Cmd:   []string{"sh", "-c", "sleep infinity"},
+		// the sandbox runs as this process' user, which can then open its
+		// namespace without CAP_SYS_PTRACE
+		User: fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
 	}
 	hostConfig := &container.HostConfig{
 		AutoRemove:  true,
-		NetworkMode: container.NetworkMode(networkResp.ID),
-	} 
+		NetworkMode: container.NetworkMode(endpoints[0].NetworkID),
+	}
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkNames[0]: endpoints[0],
+		},
+	}
 
 	// Create the container
 	containerResp, err := cli.ContainerCreate(
 		context.Background(),
 		containerConfig,
 		hostConfig,
-		nil,
+		networkingConfig,
 		nil,
 		containerName, // Name for the container
 	)
@@ -67,6 +98,13 @@ func CreateContainer(name string) (string, error) {
 	}
 	logs.Logger.Infof("Created container: %s\n", containerResp.ID)
 
+	for i := 1; i < len(endpoints); i++ {
+		if err := cli.NetworkConnect(context.Background(), endpoints[i].NetworkID, containerResp.ID, endpoints[i]); err != nil {
+			logs.Logger.Errorf("Failed to connect container to network %s: %v", networkNames[i], err)
+			return "", err
+		}
+	}
+
 	if err := cli.ContainerStart(context.Background(), containerResp.ID, container.StartOptions{}); err != nil {
 		logs.Logger.Errorf("Failed to start container: %v", err)
 		return "", err
@@ -79,9 +117,101 @@ func CreateContainer(name string) (string, error) {
 		return "", err
 	}
 	netnsPath := fmt.Sprintf("/proc/%d/ns/net", pid)
+	if err := resolveSourceIfaces(cli, containerResp.ID, netnsPath, networkNames, attachments); err != nil {
+		logs.Logger.Errorf("Failed to find the interfaces of container %s: %v", name, err)
+		return "", err
+	}
 	return netnsPath, nil
 }
 
+// resolveSourceIfaces sets the SourceIface of the attachments without one to
+// the interface of their endpoint in networkNames inside the container.
+func resolveSourceIfaces(cli *client.Client, containerID, nsPath string, networkNames []string, attachments []NetworkAttachment) error {
+	info, err := cli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return err
+	}
+	ops := netlink.DefaultNetlinkOps()
+	for i := range attachments {
+		if attachments[i].SourceIface != "" {
+			continue
+		}
+		endpoint, ok := info.NetworkSettings.Networks[networkNames[i]]
+		if !ok {
+			return fmt.Errorf("container %s is not connected to network %s", containerID, networkNames[i])
+		}
+		var ips []net.IP
+		for _, addr := range []string{endpoint.IPAddress, endpoint.GlobalIPv6Address} {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		iface, err := ops.LinkByAddr(nsPath, endpoint.MacAddress, ips)
+		if err != nil {
+			return fmt.Errorf("failed to find the interface of network %s: %w", networkNames[i], err)
+		}
+		attachments[i].SourceIface = iface
+	}
+	return nil
+}
+
+// sandboxNetwork describes the docker network of an attachment, named after
+// its subnets so VMs whose attachments share the subnets share the network,
+// and the container's endpoint in it.
+func sandboxNetwork(a NetworkAttachment) (string, network.CreateOptions, *network.EndpointSettings) {
+	options := network.CreateOptions{
+		Driver: "bridge",
+		Labels: map[string]string{
+			SandboxLabel: "true",
+		},
+		IPAM:    &network.IPAM{},
+		Options: map[string]string{},
+	}
+	endpoint := &network.EndpointSettings{
+		IPAMConfig: &network.EndpointIPAMConfig{},
+		MacAddress: a.MAC,
+	}
+	networkName := "testJailer"
+	// docker network names can't hold the ':' and '/' of a CIDR
+	sanitize := strings.NewReplacer(":", "-", "/", "-")
+	for _, lease := range a.Leases {
+		options.IPAM.Config = append(options.IPAM.Config, network.IPAMConfig{
+			Subnet:  lease.Subnet().String(),
+			Gateway: lease.Gateway.String(),
+		})
+		if lease.IsIPv6() {
+			enableIPv6 := true
+			options.EnableIPv6 = &enableIPv6
+			endpoint.IPAMConfig.IPv6Address = lease.IP.IP.String()
+		} else {
+			endpoint.IPAMConfig.IPv4Address = lease.IP.IP.String()
+		}
+		networkName += "-" + sanitize.Replace(lease.Subnet().String())
+	}
+	return networkName, options, endpoint
+}
+
+// ensureNetwork reuses the sandbox network when an earlier VM already created
+// it, so several VMs can share the subnet managed by ipam.
+func ensureNetwork(cli *client.Client, name string, options network.CreateOptions) (string, error) {
+	existing, err := cli.NetworkInspect(context.Background(), name, network.InspectOptions{})
+	if err == nil {
+		if existing.Labels[SandboxLabel] != "true" {
+			return "", fmt.Errorf("network %s exists but is not a sandbox network", name)
+		}
+		return existing.ID, nil
+	}
+	if !client.IsErrNotFound(err) {
+		return "", err
+	}
+	networkResp, err := cli.NetworkCreate(context.Background(), name, options)
+	if err != nil {
+		return "", err
+	}
+	logs.Logger.Infof("Created network: %s\n", name)
+	return networkResp.ID, nil
+}
+
 func getContainerPID(containerID string) (int, error) {
 	cmd := exec.Command("docker", "inspect", "--format", "{{.State.Pid}}", containerID)
 	output, err := cmd.Output()
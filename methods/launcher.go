@@ -0,0 +1,539 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	models "github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	"github.com/sirupsen/logrus"
+	"github.com/weaveworks/ignite/pkg/logs"
+
+	"ranjankuldeep/test/helper"
+	"ranjankuldeep/test/idalloc"
+	"ranjankuldeep/test/preflight"
+	"ranjankuldeep/test/privilege"
+	"ranjankuldeep/test/snapshot"
+	"ranjankuldeep/test/vmid"
+)
+
+const (
+	DefaultKernelArgs    = "console=ttyS0 reboot=k panic=1 pci=off"
+	DefaultChrootBaseDir = helper.ChrootBaseDir
+	DefaultOverlayDir    = "/var/lib/firetest/overlays"
+	// APISocketName is the Firecracker API socket, relative to the chroot.
+	APISocketName = "api.socket"
+	// RootDriveID is the drive created from Spec.RootImage.
+	RootDriveID = "rootfs"
+	// IdentityStateFile records the identities allocated to VMs.
+	IdentityStateFile = "/var/lib/firetest/identities.json"
+)
+
+// Spec describes a jailed VM.
+type Spec struct {
+	ID vmid.ID
+	// UID and GID the VMM runs as. When Identities is set they are allocated
+	// from it instead and released when the VM exits.
+	UID, GID   int
+	Identities *idalloc.Allocator
+
+	KernelImagePath string
+	// KernelArgs defaults to DefaultKernelArgs, the arguments of the network
+	// are appended.
+	KernelArgs string
+	// RootImage is a base image the VM boots from without modifying it, its
+	// writes go to a device mapper snapshot kept in OverlayDir, which
+	// defaults to DefaultOverlayDir. The snapshot is removed when the VM
+	// exits. Leave RootImage empty to pass the root drive in Drives instead.
+	RootImage  string
+	OverlayDir string
+	Drives     []models.Drive
+	VcpuCount  int64
+	MemSizeMib int64
+	Resources  Resources
+
+	// JailerBinary and FirecrackerBinary default to the ones the privileged
+	// helper starts, others require running as root.
+	JailerBinary      string
+	FirecrackerBinary string
+	// ChrootBaseDir defaults to DefaultChrootBaseDir, the only one the
+	// privileged helper works in, others require running as root.
+	ChrootBaseDir string
+	NumaNode      int
+
+	// NetNS is the sandbox namespace the VM runs in, see CreateContainer.
+	NetNS   string
+	Network []NetworkAttachment
+
+	// Stdin, Stdout and Stderr of the VMM default to the process' own,
+	// unless Daemonize is set.
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+	LogLevel       string
+	// Daemonize detaches the VMM from this process, its stdio and signals,
+	// so the VM keeps running when the process exits. Use Attach to manage
+	// it again.
+	Daemonize bool
+}
+
+func (s Spec) withDefaults() Spec {
+	if s.KernelArgs == "" {
+		s.KernelArgs = DefaultKernelArgs
+	}
+	if s.VcpuCount == 0 {
+		s.VcpuCount = 1
+	}
+	if s.MemSizeMib == 0 {
+		s.MemSizeMib = 512
+	}
+	if s.JailerBinary == "" {
+		s.JailerBinary = helper.JailerBinary
+	}
+	if s.FirecrackerBinary == "" {
+		s.FirecrackerBinary = helper.FirecrackerBinary
+	}
+	if s.OverlayDir == "" {
+		s.OverlayDir = DefaultOverlayDir
+	}
+	if s.ChrootBaseDir == "" {
+		s.ChrootBaseDir = DefaultChrootBaseDir
+	}
+	if !s.Daemonize {
+		if s.Stdin == nil {
+			s.Stdin = os.Stdin
+		}
+		if s.Stdout == nil {
+			s.Stdout = os.Stdout
+		}
+		if s.Stderr == nil {
+			s.Stderr = os.Stderr
+		}
+	}
+	if s.LogLevel == "" {
+		s.LogLevel = "Info"
+	}
+	return s
+}
+
+func (s Spec) validate() error {
+	if err := s.ID.Validate(); err != nil {
+		return err
+	}
+	if s.KernelImagePath == "" {
+		return fmt.Errorf("VM %s has no kernel image", s.ID)
+	}
+	hasRoot := s.RootImage != ""
+	for _, drive := range s.Drives {
+		if firecracker.BoolValue(drive.IsRootDevice) {
+			if hasRoot {
+				return fmt.Errorf("VM %s has more than one root drive", s.ID)
+			}
+			hasRoot = true
+		}
+	}
+	if !hasRoot {
+		return fmt.Errorf("VM %s has no root drive", s.ID)
+	}
+	if err := s.Resources.validate(s.MemSizeMib); err != nil {
+		return fmt.Errorf("VM %s: %w", s.ID, err)
+	}
+	if len(s.Network) > 0 && s.NetNS == "" && s.Network[0].Datapath != DatapathBridge {
+		return fmt.Errorf("VM %s has a network but no sandbox namespace", s.ID)
+	}
+	return nil
+}
+
+// preflightConfig is what the host needs to launch the VM.
+func (s Spec) preflightConfig() preflight.Config {
+	cfg := preflight.Config{
+		JailerBinary:      s.JailerBinary,
+		FirecrackerBinary: s.FirecrackerBinary,
+		KernelImage:       s.KernelImagePath,
+		Snapshots:         s.RootImage != "",
+		Helper:            true,
+	}
+	if len(s.Network) > 0 {
+		cfg.Privileges = append(cfg.Privileges, privilege.Network)
+	}
+	if s.RootImage != "" {
+		cfg.Drives = append(cfg.Drives, s.RootImage)
+		cfg.ReadOnly = append(cfg.ReadOnly, s.RootImage)
+	}
+	for _, drive := range s.Drives {
+		path := firecracker.StringValue(drive.PathOnHost)
+		cfg.Drives = append(cfg.Drives, path)
+		if firecracker.BoolValue(drive.IsReadOnly) {
+			cfg.ReadOnly = append(cfg.ReadOnly, path)
+		}
+	}
+	r := s.Resources
+	if r.CPUQuota > 0 || r.CPUWeight > 0 {
+		cfg.CgroupControllers = append(cfg.CgroupControllers, "cpu")
+	}
+	if r.MemoryMax > 0 {
+		cfg.CgroupControllers = append(cfg.CgroupControllers, "memory")
+	}
+	if len(r.IOMax) > 0 {
+		cfg.CgroupControllers = append(cfg.CgroupControllers, "io")
+	}
+	if r.PidsMax > 0 {
+		cfg.CgroupControllers = append(cfg.CgroupControllers, "pids")
+	}
+	return cfg
+}
+
+// VM is a jailed Firecracker VM started by LaunchJailedVM or found by Attach.
+type VM struct {
+	ID      vmid.ID
+	machine *firecracker.Machine
+	pid     int
+	cgroup  string
+
+	exited  chan struct{}
+	exitErr error
+
+	mu     sync.Mutex
+	onExit []func() error
+}
+
+// LaunchJailedVM sets up the VM's network, starts the jailer and boots the
+// VM. The VM keeps running when ctx is done, ctx only bounds the launch.
+// Everything set up for the VM is released when its VMM exits, or right away
+// if the launch fails.
+func LaunchJailedVM(ctx context.Context, spec Spec) (*VM, error) {
+	spec = spec.withDefaults()
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+	if err := preflight.Run(spec.preflightConfig()); err != nil {
+		return nil, err
+	}
+	rec := Record{
+		ID:                spec.ID,
+		ChrootBaseDir:     spec.ChrootBaseDir,
+		FirecrackerBinary: spec.FirecrackerBinary,
+	}
+	// a VM using the same ID may still be running, its resources must not be
+	// released if this launch fails, so nothing is set up before the launch
+	// owns the ID
+	if _, err := os.Stat(chrootDir(rec.jailerConfig())); err == nil {
+		return nil, fmt.Errorf("chroot of VM %s already exists, is it still running?", spec.ID)
+	}
+	if err := claimRecord(rec); err != nil {
+		return nil, err
+	}
+	vm := &VM{ID: spec.ID, exited: make(chan struct{})}
+	vm.addOnExit(func() error {
+		return removeRecord(spec.ID)
+	})
+	fail := func(err error) (*VM, error) {
+		if cleanupErr := vm.cleanup(); cleanupErr != nil {
+			logs.Logger.Errorf("Failed to clean up VM %s: %v", spec.ID, cleanupErr)
+		}
+		return nil, err
+	}
+
+	if spec.Identities != nil {
+		id, err := spec.Identities.Allocate(spec.ID.String())
+		if err != nil {
+			return fail(fmt.Errorf("failed to allocate identity of VM %s: %w", spec.ID, err))
+		}
+		vm.addOnExit(func() error {
+			return spec.Identities.Release(spec.ID.String())
+		})
+		spec.UID, spec.GID = id.UID, id.GID
+		rec.IdentityState, rec.IdentityRange = spec.Identities.Path(), spec.Identities.Range()
+	}
+	rec.UID, rec.GID = spec.UID, spec.GID
+	// the helper only works on the VM's resources once it is claimed, the
+	// claim is released after all of them
+	if err := helper.Claim(spec.ID, spec.UID, spec.GID, spec.NetNS); err != nil {
+		return fail(fmt.Errorf("failed to claim VM %s: %w", spec.ID, err))
+	}
+	vm.addOnExit(func() error {
+		return helper.Release(spec.ID)
+	})
+
+	// LinkDrivesHandler rewrites the paths of the drives, not the caller's
+	drives := append([]models.Drive(nil), spec.Drives...)
+	if spec.RootImage != "" {
+		if err := os.MkdirAll(spec.OverlayDir, 0755); err != nil {
+			return fail(fmt.Errorf("failed to create overlay directory: %w", err))
+		}
+		device, err := snapshot.CreateDeviceMapper(spec.ID, spec.RootImage, spec.OverlayDir)
+		if err != nil {
+			return fail(fmt.Errorf("failed to create root drive of VM %s: %w", spec.ID, err))
+		}
+		vm.addOnExit(device.Cleanup)
+		rec.OverlayDir, rec.Loops = spec.OverlayDir, device.Loops()
+		// the device node is placed in the chroot by LinkDrivesHandler
+		drives = append([]models.Drive{{
+			DriveID:      firecracker.String(RootDriveID),
+			PathOnHost:   firecracker.String(filepath.Join("/dev/mapper", device.OverlayName)),
+			IsRootDevice: firecracker.Bool(true),
+			IsReadOnly:   firecracker.Bool(false),
+		}}, drives...)
+	}
+
+	var networkIfaces []firecracker.NetworkInterface
+	kernelArgs := spec.KernelArgs
+	var metadata interface{}
+	if len(spec.Network) > 0 {
+		// name the taps after the VM, they live in the host namespace with
+		// DatapathBridge
+		network := make([]NetworkAttachment, len(spec.Network))
+		for i, a := range spec.Network {
+			if a.TapName == "" {
+				a.TapName = spec.ID.TapName(i)
+			}
+			network[i] = a
+		}
+		spec.Network = network
+
+		ifaces, networkMetadata, err := SetUpSandBoxNetwork(spec.NetNS, spec.UID, spec.GID, spec.Network)
+		if err != nil {
+			return fail(fmt.Errorf("failed to set up network of VM %s: %w", spec.ID, err))
+		}
+		vm.addOnExit(func() error {
+			return TearDownSandBoxNetwork(spec.NetNS, spec.Network)
+		})
+		networkIfaces = ifaces
+		rec.NetNS, rec.Network = spec.NetNS, spec.Network
+		if args := networkMetadata.KernelArgs(); args != "" {
+			kernelArgs += " " + args
+		}
+		metadata = map[string]interface{}{"network": networkMetadata}
+	}
+
+	fcCfg := firecracker.Config{
+		SocketPath:      APISocketName,
+		KernelImagePath: spec.KernelImagePath,
+		KernelArgs:      kernelArgs,
+		Drives:          drives,
+		LogLevel:        spec.LogLevel,
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  firecracker.Int64(spec.VcpuCount),
+			Smt:        firecracker.Bool(false),
+			MemSizeMib: firecracker.Int64(spec.MemSizeMib),
+		},
+		JailerCfg: &firecracker.JailerConfig{
+			UID:            firecracker.Int(spec.UID),
+			GID:            firecracker.Int(spec.GID),
+			ID:             spec.ID.String(),
+			NumaNode:       firecracker.Int(spec.NumaNode),
+			JailerBinary:   spec.JailerBinary,
+			ChrootBaseDir:  spec.ChrootBaseDir,
+			Stdin:          spec.Stdin,
+			Stdout:         spec.Stdout,
+			Stderr:         spec.Stderr,
+			Daemonize:      spec.Daemonize,
+			CgroupVersion:  "2",
+			ChrootStrategy: NewPrePlacedFilesStrategy(spec.KernelImagePath),
+			ExecFile:       spec.FirecrackerBinary,
+		},
+		NetNS:             spec.NetNS,
+		NetworkInterfaces: networkIfaces,
+	}
+	if spec.Daemonize {
+		fcCfg.ForwardSignals = []os.Signal{}
+	}
+
+	vm.addOnExit(func() error {
+		return CleanUpChroot(fcCfg.JailerCfg)
+	})
+
+	// the VMM outlives ctx, its process is bound to vmmCtx
+	vmmCtx, cancel := context.WithCancel(context.Background())
+	vm.addOnExit(func() error {
+		cancel()
+		return nil
+	})
+	cgroupArgs, err := spec.Resources.cgroupArgs()
+	if err != nil {
+		return fail(fmt.Errorf("invalid resources of VM %s: %w", spec.ID, err))
+	}
+	m, err := firecracker.NewMachine(vmmCtx, fcCfg,
+		firecracker.WithLogger(logrus.NewEntry(logs.Logger.Logger)),
+		firecracker.WithProcessRunner(jailerCommand(vmmCtx, fcCfg, cgroupArgs)))
+	if err != nil {
+		return fail(fmt.Errorf("failed to create VM %s: %w", spec.ID, err))
+	}
+	if metadata != nil {
+		m.Handlers.FcInit = m.Handlers.FcInit.Append(firecracker.NewSetMetadataHandler(metadata))
+	}
+	vm.machine = m
+	vm.cgroup = jailerCgroup(fcCfg.JailerCfg)
+
+	// the SDK stops the VMM once the context passed to Start is done, so the
+	// VM is started with vmmCtx and ctx only aborts the launch
+	booted := make(chan struct{})
+	go grantSocket(m.Cfg.SocketPath, booted)
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+			aborted <- true
+		case <-booted:
+			aborted <- false
+		}
+	}()
+	err = m.Start(vmmCtx)
+	close(booted)
+	if <-aborted && err == nil {
+		err = ctx.Err()
+		// the VMM is stopping, release the VM once it is gone
+		go func() {
+			m.Wait(context.Background())
+			vm.exit()
+		}()
+		<-vm.exited
+		return nil, fmt.Errorf("failed to start VM %s: %w", spec.ID, err)
+	}
+	if err != nil {
+		// the SDK can't signal the jailed VMM without root
+		if pid, pidErr := m.PID(); pidErr == nil {
+			vm.pid = pid
+			vm.kill()
+		}
+		return fail(fmt.Errorf("failed to start VM %s: %w", spec.ID, err))
+	}
+	logs.Logger.Infof("Started VM %s", spec.ID)
+
+	go func() {
+		vm.exitErr = m.Wait(context.Background())
+		vm.exit()
+	}()
+
+	pid, err := m.PID()
+	if err != nil {
+		vm.kill()
+		<-vm.exited
+		return nil, fmt.Errorf("VM %s exited right away: %w", spec.ID, err)
+	}
+	vm.pid = pid
+	rec.PID, rec.PIDFile = pid, pidFile(spec.ID)
+	rec.Socket = spec.ID.SocketPath(spec.ChrootBaseDir, spec.FirecrackerBinary, APISocketName)
+	if err := writePIDFile(rec.PIDFile, pid); err != nil {
+		logs.Logger.Errorf("Failed to write PID file of VM %s: %v", spec.ID, err)
+	}
+	if err := saveRecord(rec); err != nil {
+		logs.Logger.Errorf("Failed to record VM %s, it can't be attached to: %v", spec.ID, err)
+	}
+	return vm, nil
+}
+
+// exit releases the VM's resources once its VMM exited.
+func (vm *VM) exit() {
+	if err := vm.cleanup(); err != nil {
+		logs.Logger.Errorf("Failed to clean up VM %s: %v", vm.ID, err)
+	}
+	logs.Logger.Infof("VM %s exited", vm.ID)
+	close(vm.exited)
+}
+
+// kill sends SIGTERM to the VMM, Firecracker exits right away on it.
+func (vm *VM) kill() error {
+	if vm.pid == 0 {
+		return vm.machine.StopVMM()
+	}
+	// the VMM runs as the jailed user, the helper checks pid is the VM's
+	return helper.Kill(vm.ID, vm.pid)
+}
+
+// grantSocket hands the VMM's API socket to this process once the jailed VMM
+// created it. The SDK keeps trying to connect until it can, or until done is
+// closed.
+func grantSocket(path string, done <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Lstat(path); err == nil {
+			if err := helper.GrantSocket(path); err != nil {
+				logs.Logger.Errorf("Failed to take over API socket %s: %v", path, err)
+			}
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// addOnExit registers fn to release a resource of the VM once its VMM exits.
+// They run in reverse order of registration.
+func (vm *VM) addOnExit(fn func() error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	vm.onExit = append(vm.onExit, fn)
+}
+
+func (vm *VM) cleanup() error {
+	vm.mu.Lock()
+	fns := vm.onExit
+	vm.onExit = nil
+	vm.mu.Unlock()
+
+	var errs []error
+	for i := len(fns) - 1; i >= 0; i-- {
+		if err := fns[i](); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stop asks the guest to shut down and kills the VMM if it has not exited
+// when ctx is done. It returns once the VM's resources are released.
+func (vm *VM) Stop(ctx context.Context) error {
+	if err := vm.machine.Shutdown(ctx); err != nil {
+		logs.Logger.Errorf("Failed to shut down VM %s, stopping its VMM: %v", vm.ID, err)
+		if err := vm.kill(); err != nil {
+			return err
+		}
+	}
+	select {
+	case <-vm.exited:
+		return nil
+	case <-ctx.Done():
+	}
+	if err := vm.kill(); err != nil {
+		return err
+	}
+	<-vm.exited
+	return nil
+}
+
+// Wait blocks until the VMM exited and the VM's resources are released, or
+// until ctx is done.
+func (vm *VM) Wait(ctx context.Context) error {
+	select {
+	case <-vm.exited:
+		return vm.exitErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PID is the process ID of the jailed VMM.
+func (vm *VM) PID() (int, error) {
+	select {
+	case <-vm.exited:
+		return 0, fmt.Errorf("VM %s has exited", vm.ID)
+	default:
+	}
+	return vm.pid, nil
+}
+
+// Socket is the host path of the VMM's API socket.
+func (vm *VM) Socket() string {
+	return vm.machine.Cfg.SocketPath
+}
@@ -1,48 +1,495 @@
 package methods
 
 import (
+	"errors"
+	"fmt"
+	gonet "net"
+
+	"ranjankuldeep/test/dhcp"
+	"ranjankuldeep/test/dnsproxy"
+	"ranjankuldeep/test/firewall"
+	"ranjankuldeep/test/ipam"
 	"ranjankuldeep/test/netlink"
 
+	"github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/sys/unix"
 )
 
-func SetUpSandBoxNetwork(nsPath string, uid, gid int) error {
-	net := netlink.DefaultNetlinkOps()
-	taskTap := Task{
-		Execute: func() error {
-			logs.Logger.Infof("Attaching Tap Device %s To Sandbox %s", "tap0", nsPath)
-			if err := net.AttachTap(nsPath, "tap0", 1500, uid, gid); err != nil {
-				return err
+// Datapath is how a VM's tap device reaches the network.
+type Datapath string
+
+const (
+	// DatapathTCRedirect puts the tap in the sandbox container's namespace and
+	// mirrors its traffic to and from the container's veth.
+	DatapathTCRedirect Datapath = "tc-redirect"
+	// DatapathBridge puts the tap in the host namespace on a Linux bridge
+	// that routes and masquerades the VMs' traffic.
+	DatapathBridge Datapath = "bridge"
+)
+
+// NetworkAttachment declares one guest NIC and how it is wired inside the
+// sandbox namespace. A VM can have several, e.g. a management and a data NIC,
+// each redirected to its own sandbox interface. The kernel ip= argument
+// configures a single NIC, so with several the IPv4 leases are served over
+// DHCP or published through MMDS like IPv6 leases.
+type NetworkAttachment struct {
+	// Name is the interface name inside the guest, defaults to eth<index>.
+	Name string
+	// TapName is the tap device in the sandbox namespace, defaults to
+	// tap<index>.
+	TapName string
+	// MTU of the tap device and the guest interface, defaults to the MTU of
+	// SourceIface, or of the bridge with DatapathBridge. It must not exceed
+	// it. With DHCP the guest gets it through the interface MTU option, which
+	// DHCP clients apply. Otherwise it is only passed as the firetest.mtu=
+	// kernel argument and in MMDS, which no stock guest reads: the guest
+	// image needs an agent or init script applying it, or it keeps its
+	// default of 1500 and its packets larger than a lower MTU are dropped.
+	MTU int
+	// MAC of the guest interface, defaults to ipam.InterfaceMAC of the VM
+	// the leases belong to and the attachment's index.
+	MAC string
+	// Leases are the addresses of the interface, at most one per family.
+	Leases []*ipam.Lease
+	DNS    DNSConfig
+	// SourceIface is the sandbox interface the tap is redirected to,
+	// CreateContainer sets it to the interface of the attachment's endpoint.
+	// Defaults to eth<index>.
+	SourceIface string
+	Bandwidth   *netlink.Bandwidth
+	// Firewall requires DatapathTCRedirect.
+	Firewall *firewall.Policy
+	// DHCP serves the IPv4 lease from the sandbox namespace instead of the
+	// kernel ip= argument, for stock images running a DHCP client. It
+	// requires DatapathTCRedirect.
+	DHCP bool
+	// Datapath defaults to DatapathTCRedirect. All attachments of a VM must
+	// use the same datapath as Firecracker runs in a single namespace.
+	Datapath Datapath
+	// Bridge is the host bridge the tap joins with DatapathBridge, defaults
+	// to DefaultBridge.
+	Bridge string
+}
+
+// DNSConfig is the resolver configuration handed to the guest through the
+// kernel ip= argument, MMDS and DHCP.
+type DNSConfig struct {
+	// Servers are at most two, as many as the kernel ip= argument takes.
+	Servers []string
+	// Search domains, not expressible with the kernel ip= argument, are
+	// published through MMDS.
+	Search []string
+	// Proxy answers the guest's queries from the sandbox namespace, logging
+	// them and enforcing its allow list. Its upstreams default to Servers.
+	// It requires DatapathTCRedirect.
+	Proxy *dnsproxy.Config
+}
+
+// DefaultBridge is the host bridge used by DatapathBridge attachments.
+const DefaultBridge = "fcbr0"
+
+// defaultMTU is used on a bridge that does not exist yet.
+const defaultMTU = 1500
+
+func (a NetworkAttachment) withDefaults(index int) NetworkAttachment {
+	if a.Name == "" {
+		a.Name = fmt.Sprintf("eth%d", index)
+	}
+	if a.TapName == "" {
+		a.TapName = fmt.Sprintf("tap%d", index)
+	}
+	if a.MAC == "" && len(a.Leases) > 0 {
+		a.MAC = ipam.InterfaceMAC(a.Leases[0].ID, index)
+	}
+	if a.SourceIface == "" {
+		a.SourceIface = fmt.Sprintf("eth%d", index)
+	}
+	if a.Datapath == "" {
+		a.Datapath = DatapathTCRedirect
+	}
+	if a.Datapath == DatapathBridge && a.Bridge == "" {
+		a.Bridge = DefaultBridge
+	}
+	return a
+}
+
+func validateAttachments(attachments []NetworkAttachment) error {
+	for i, attachment := range attachments {
+		a := attachment.withDefaults(i)
+		switch a.Datapath {
+		case DatapathTCRedirect:
+		case DatapathBridge:
+			if a.Firewall != nil {
+				return fmt.Errorf("attachment %s: firewall policies need the %s datapath", a.Name, DatapathTCRedirect)
 			}
-			return nil
+			if a.DHCP {
+				return fmt.Errorf("attachment %s: DHCP needs the %s datapath", a.Name, DatapathTCRedirect)
+			}
+			if a.DNS.Proxy != nil {
+				return fmt.Errorf("attachment %s: the DNS proxy needs the %s datapath", a.Name, DatapathTCRedirect)
+			}
+		default:
+			return fmt.Errorf("attachment %s: unknown datapath %q", a.Name, a.Datapath)
+		}
+		if len(a.DNS.Servers) > 2 {
+			return fmt.Errorf("attachment %s has %d DNS servers, at most 2 are supported", a.Name, len(a.DNS.Servers))
+		}
+		if a.DNS.Proxy != nil && len(a.proxyConfig().Upstreams) == 0 {
+			return fmt.Errorf("attachment %s: the DNS proxy needs upstreams or DNS servers", a.Name)
+		}
+		if first := attachments[0].withDefaults(0); a.Datapath != first.Datapath {
+			return fmt.Errorf("attachment %s uses the %s datapath but %s uses %s", a.Name, a.Datapath, first.Name, first.Datapath)
+		}
+	}
+	return nil
+}
+
+// bridgeTasks wires a DatapathBridge attachment: the shared bridge holds the
+// leases' gateways and masquerades the leased addresses under the tap's name,
+// the tap joins the bridge.
+func bridgeTasks(net netlink.NetlinkOps, a NetworkAttachment, uid, gid int) []Task {
+	var gateways, sources []gonet.IPNet
+	for _, lease := range a.Leases {
+		gateways = append(gateways, gonet.IPNet{IP: lease.Gateway, Mask: lease.IP.Mask})
+		bits := len(lease.IP.IP) * 8
+		sources = append(sources, gonet.IPNet{IP: lease.IP.IP, Mask: gonet.CIDRMask(bits, bits)})
+	}
+	return []Task{
+		{
+			Execute: func() error {
+				logs.Logger.Infof("Ensuring bridge %s", a.Bridge)
+				if err := net.EnsureBridge(a.Bridge, gateways); err != nil {
+					return err
+				}
+				return net.EnableMasquerade(a.Bridge, a.TapName, sources)
+			},
+			// the bridge is shared with other VMs, only the VM's rules go
+			Cleanup: func() error {
+				return net.RemoveMasquerade(a.Bridge, a.TapName)
+			},
 		},
-		Cleanup: func() error {
-			logs.Logger.Info("Automatic Cleanup of Tap Devices")
-			return nil
+		{
+			Execute: func() error {
+				logs.Logger.Infof("Attaching Tap Device %s To Bridge %s", a.TapName, a.Bridge)
+				return net.AttachTapToBridge(a.Bridge, a.TapName, a.MTU, uid, gid)
+			},
+			Cleanup: func() error {
+				logs.Logger.Infof("Removing Tap Device %s", a.TapName)
+				return netlink.WithHostNS(func() error {
+					return net.RemoveLink(a.TapName)
+				})
+			},
 		},
 	}
-	taskTCRedirect := Task{
-		Execute: func() error {
-			logs.Logger.Infof("Adding tc redirect between %s:%s", "eth0", "tap0")
-			sandboxMainIface := "eth0"
-			sandboxTapIface := "tap0"
+}
 
-			if err := netlink.DefaultNetlinkOps().AddTcRedirect(nsPath, sandboxMainIface, sandboxTapIface); err != nil {
-				logs.Logger.Errorf("Failed to setup tc redirect %v", err)
-				return err
-			}
-			return nil
-		},
-		Cleanup: func() error {
-			return nil
+// resolveMTU inherits the MTU of the link the tap's traffic leaves through, or
+// checks that the requested MTU fits it. A bridge that does not exist yet has
+// no ports to constrain the tap.
+func (a NetworkAttachment) resolveMTU(net netlink.NetlinkOps, nsPath string) (NetworkAttachment, error) {
+	parentNS, parent := nsPath, a.SourceIface
+	if a.Datapath == DatapathBridge {
+		parentNS, parent = netlink.HostNSPath, a.Bridge
+	}
+	mtu, err := net.TapMTU(parentNS, parent, a.TapName, a.MTU)
+	if a.Datapath == DatapathBridge && errors.Is(err, netlink.ErrLinkNotFound) {
+		if a.MTU == 0 {
+			a.MTU = defaultMTU
+		}
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+	a.MTU = mtu
+	return a, nil
+}
+
+func (a NetworkAttachment) lease4() *ipam.Lease {
+	for _, lease := range a.Leases {
+		if !lease.IsIPv6() {
+			return lease
+		}
+	}
+	return nil
+}
+
+// proxyConfig is the configuration of the attachment's DNS proxy, forwarding
+// to the servers the guest is told about unless it has upstreams.
+func (a NetworkAttachment) proxyConfig() dnsproxy.Config {
+	cfg := *a.DNS.Proxy
+	if len(cfg.Upstreams) == 0 {
+		cfg.Upstreams = a.DNS.Servers
+	}
+	return cfg
+}
+
+// dhcpConfig is what the attachment's DHCP server hands out for lease.
+func (a NetworkAttachment) dhcpConfig(lease *ipam.Lease) dhcp.Config {
+	return dhcp.Config{
+		Lease:       lease,
+		MAC:         a.MAC,
+		Nameservers: a.DNS.Servers,
+		Search:      a.DNS.Search,
+		MTU:         a.MTU,
+	}
+}
+
+// networkInterface builds the firecracker interface of the attachment. The
+// IPv4 lease of a VM's only NIC is configured through the kernel ip=
+// argument. The complete, possibly dual-stack or IPv6-only, configuration is
+// returned for MMDS, which the interface is then allowed to reach whenever it
+// has a lease or search domains ip= does not cover.
+func (a NetworkAttachment) networkInterface(shared bool) (firecracker.NetworkInterface, ipam.InterfaceConfig) {
+	guest := ipam.GuestConfig(a.Name, a.DNS.Servers, a.Leases...)
+	guest.Search = a.DNS.Search
+	guest.MAC = a.MAC
+	guest.MTU = a.MTU
+	iface := firecracker.NetworkInterface{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  a.MAC,
+			HostDevName: a.TapName,
 		},
+		AllowMMDS: len(a.DNS.Search) > 0,
+	}
+	for _, lease := range a.Leases {
+		if lease.IsIPv6() {
+			iface.AllowMMDS = true
+			continue
+		}
+		if a.DHCP {
+			continue
+		}
+		// the SDK only passes ip= for a single interface
+		if shared {
+			iface.AllowMMDS = true
+			continue
+		}
+		iface.StaticConfiguration.IPConfiguration = lease.IPConfiguration(a.Name, a.DNS.Servers)
+	}
+	return iface, guest
+}
+
+// SetUpSandBoxNetwork creates a tap device inside the sandbox namespace for
+// every attachment and redirects its traffic to the attachment's source
+// interface, or with DatapathBridge creates it on the host bridge, in which
+// case nsPath is not used and Firecracker must run in the host namespace.
+// Taps with a Bandwidth are shaped on the host before the VM boots,
+// and taps with a Firewall send the guest's egress through the sandbox
+// firewall instead of the tc redirect. It returns the matching firecracker
+// interfaces and the network document to publish through MMDS, whose
+// KernelArgs carry the interface MTUs. A requested MTU larger than the
+// parent link fails with netlink.MTUExceedsParentError.
+func SetUpSandBoxNetwork(nsPath string, uid, gid int, attachments []NetworkAttachment) ([]firecracker.NetworkInterface, ipam.NetworkMetadata, error) {
+	if err := validateAttachments(attachments); err != nil {
+		return nil, ipam.NetworkMetadata{}, err
+	}
+	net := netlink.DefaultNetlinkOps()
+	var tasks []Task
+	var ifaces []firecracker.NetworkInterface
+	var metadata ipam.NetworkMetadata
+	for i, attachment := range attachments {
+		a, err := attachment.withDefaults(i).resolveMTU(net, nsPath)
+		if err != nil {
+			return nil, ipam.NetworkMetadata{}, err
+		}
+		iface, guest := a.networkInterface(len(attachments) > 1)
+		ifaces = append(ifaces, iface)
+		metadata.Interfaces = append(metadata.Interfaces, guest)
+
+		if a.Datapath == DatapathBridge {
+			tasks = append(tasks, bridgeTasks(net, a, uid, gid)...)
+			if a.Bandwidth != nil {
+				tasks = append(tasks, Task{
+					Execute: func() error {
+						logs.Logger.Infof("Shaping bandwidth of %s", a.TapName)
+						return net.SetBandwidth(netlink.HostNSPath, a.TapName, *a.Bandwidth)
+					},
+					Cleanup: func() error {
+						return net.ClearBandwidth(netlink.HostNSPath, a.TapName)
+					},
+				})
+			}
+			continue
+		}
+
+		taskTap := Task{
+			Execute: func() error {
+				logs.Logger.Infof("Attaching Tap Device %s To Sandbox %s", a.TapName, nsPath)
+				if err := net.AttachTap(nsPath, a.TapName, a.MTU, uid, gid); err != nil {
+					return err
+				}
+				return nil
+			},
+			Cleanup: func() error {
+				logs.Logger.Infof("Removing Tap Device %s", a.TapName)
+				return netlink.WithNetNSByPath(nsPath, func() error {
+					return net.RemoveLink(a.TapName)
+				})
+			},
+		}
+		taskTCRedirect := Task{
+			Execute: func() error {
+				logs.Logger.Infof("Adding tc redirect between %s:%s", a.SourceIface, a.TapName)
+				redirect := net.AddTcRedirect
+				if a.Firewall != nil {
+					redirect = net.AddTcRedirectFrom
+				}
+				if err := redirect(nsPath, a.SourceIface, a.TapName); err != nil {
+					logs.Logger.Errorf("Failed to setup tc redirect %v", err)
+					return err
+				}
+				return nil
+			},
+			Cleanup: func() error {
+				return nil
+			},
+		}
+		tasks = append(tasks, taskTap, taskTCRedirect)
+		if a.Bandwidth != nil {
+			tasks = append(tasks, Task{
+				Execute: func() error {
+					logs.Logger.Infof("Shaping bandwidth of %s", a.TapName)
+					return net.SetBandwidth(nsPath, a.TapName, *a.Bandwidth)
+				},
+				Cleanup: func() error {
+					return net.ClearBandwidth(nsPath, a.TapName)
+				},
+			})
+		}
+		if lease := a.lease4(); a.DHCP && lease != nil {
+			tasks = append(tasks, Task{
+				Execute: func() error {
+					if err := net.AddTcLocalDelivery(nsPath, a.TapName, unix.IPPROTO_UDP, dhcpv4.ServerPort); err != nil {
+						return err
+					}
+					return dhcp.Serve(nsPath, a.TapName, a.dhcpConfig(lease))
+				},
+				Cleanup: func() error {
+					return dhcp.Stop(nsPath, a.TapName)
+				},
+			})
+		}
+		if a.DNS.Proxy != nil {
+			tasks = append(tasks, Task{
+				Execute: func() error {
+					for _, proto := range []uint8{unix.IPPROTO_UDP, unix.IPPROTO_TCP} {
+						if err := net.AddTcLocalDelivery(nsPath, a.TapName, proto, 53); err != nil {
+							return err
+						}
+					}
+					return dnsproxy.Start(nsPath, a.TapName, a.proxyConfig())
+				},
+				Cleanup: func() error {
+					return dnsproxy.Stop(nsPath, a.TapName)
+				},
+			})
+		}
+		if a.Firewall != nil {
+			policy := *a.Firewall
+			policy.Local = append([]firewall.Rule{}, policy.Local...)
+			if a.DHCP {
+				policy.Local = append(policy.Local,
+					firewall.Rule{CIDR: "255.255.255.255/32", Protocol: "udp", Port: dhcpv4.ServerPort})
+			}
+			// keep the captured queries from being forwarded by the firewall
+			if a.DNS.Proxy != nil {
+				for _, cidr := range []string{"0.0.0.0/0", "::/0"} {
+					policy.Local = append(policy.Local,
+						firewall.Rule{CIDR: cidr, Protocol: "udp", Port: 53},
+						firewall.Rule{CIDR: cidr, Protocol: "tcp", Port: 53})
+				}
+			}
+			tasks = append(tasks, Task{
+				Execute: func() error {
+					logs.Logger.Infof("Applying egress firewall to %s", a.TapName)
+					return firewall.Apply(nsPath, a.TapName, a.SourceIface, policy)
+				},
+				Cleanup: func() error {
+					return firewall.Remove(nsPath, a.TapName)
+				},
+			})
+		}
 	}
-	tasks := []Task{taskTap, taskTCRedirect}
 	if err := executeTasks(tasks); err != nil {
 		logs.Logger.Errorf("Failed to execute all tasks: %v\n", err)
-		return err
+		return nil, ipam.NetworkMetadata{}, err
 	}
 	logs.Logger.Info("Sandbox Network Setup Succesfully")
+	return ifaces, metadata, nil
+}
+
+// TearDownSandBoxNetwork removes what SetUpSandBoxNetwork installed that does
+// not go away with the sandbox namespace: firewall rules, DHCP servers, DNS
+// proxies, and the taps on the host bridge and their masquerade rules. The
+// bridge itself is shared and kept.
+func TearDownSandBoxNetwork(nsPath string, attachments []NetworkAttachment) error {
+	net := netlink.DefaultNetlinkOps()
+	for i, attachment := range attachments {
+		a := attachment.withDefaults(i)
+		if a.Datapath == DatapathBridge {
+			if err := net.RemoveMasquerade(a.Bridge, a.TapName); err != nil {
+				logs.Logger.Errorf("Failed to remove masquerade of %s: %v", a.TapName, err)
+				return err
+			}
+			if err := netlink.WithHostNS(func() error {
+				return net.RemoveLink(a.TapName)
+			}); err != nil {
+				logs.Logger.Errorf("Failed to remove tap %s: %v", a.TapName, err)
+				return err
+			}
+			continue
+		}
+		if err := dhcp.Stop(nsPath, a.TapName); err != nil {
+			logs.Logger.Errorf("Failed to stop DHCP server of %s: %v", a.TapName, err)
+		}
+		if err := dnsproxy.Stop(nsPath, a.TapName); err != nil {
+			logs.Logger.Errorf("Failed to stop DNS proxy of %s: %v", a.TapName, err)
+		}
+		if a.Firewall == nil {
+			continue
+		}
+		if err := firewall.Remove(nsPath, a.TapName); err != nil {
+			logs.Logger.Errorf("Failed to remove firewall of %s: %v", a.TapName, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// ResumeSandBoxNetwork restarts the services SetUpSandBoxNetwork runs inside
+// this process, DHCP servers and DNS proxies, for a VM whose network was set
+// up by a previous process. The taps, filters and firewall rules are kernel
+// state that outlived it and are left alone.
+func ResumeSandBoxNetwork(nsPath string, attachments []NetworkAttachment) error {
+	net := netlink.DefaultNetlinkOps()
+	for i, attachment := range attachments {
+		a := attachment.withDefaults(i)
+		if a.Datapath == DatapathBridge {
+			continue
+		}
+		if a.MTU == 0 {
+			mtu, err := net.LinkMTU(nsPath, a.TapName)
+			if err != nil {
+				return err
+			}
+			a.MTU = mtu
+		}
+		if lease := a.lease4(); a.DHCP && lease != nil {
+			logs.Logger.Infof("Resuming DHCP server of %s", a.TapName)
+			if err := dhcp.Serve(nsPath, a.TapName, a.dhcpConfig(lease)); err != nil {
+				return err
+			}
+		}
+		if a.DNS.Proxy != nil {
+			logs.Logger.Infof("Resuming DNS proxy of %s", a.TapName)
+			if err := dnsproxy.Start(nsPath, a.TapName, a.proxyConfig()); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,255 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/sys/unix"
+)
+
+// EnsureBridge creates the host bridge if it does not exist yet, assigns it
+// the given gateway addresses and brings it up. It is safe to call for every
+// VM sharing the bridge.
+func (ops *defaultNetlinkOps) EnsureBridge(name string, gateways []net.IPNet) error {
+	return WithHostNS(func() error {
+		return ops.ensureBridge(name, gateways)
+	})
+}
+
+func (ops *defaultNetlinkOps) ensureBridge(name string, gateways []net.IPNet) error {
+	link, err := ops.GetLink(name)
+	if errors.Is(err, ErrLinkNotFound) {
+		attrs := netlink.NewLinkAttrs()
+		attrs.Name = name
+		bridge := &netlink.Bridge{LinkAttrs: attrs}
+		logs.Logger.Infof("Creating bridge %s", name)
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return fmt.Errorf("failed to create bridge %s: %w", name, linkError(err, name))
+		}
+		link, err = ops.GetLink(name)
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := link.(*netlink.Bridge); !ok {
+		return fmt.Errorf("%w: %s is a %s, not a bridge", ErrLinkExists, name, link.Type())
+	}
+
+	existing, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	assigned := map[string]bool{}
+	for _, addr := range existing {
+		assigned[addr.IPNet.String()] = true
+	}
+	for _, gw := range gateways {
+		addr := netlink.Addr{IPNet: &net.IPNet{IP: gw.IP, Mask: gw.Mask}}
+		if assigned[addr.IPNet.String()] {
+			continue
+		}
+		if err := ops.AddLinkIP(link, addr); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return permissionError(netlink.LinkSetUp(link))
+}
+
+// RemoveBridge deletes the host bridge. Taps still attached to it are
+// released by the kernel, not deleted.
+func (ops *defaultNetlinkOps) RemoveBridge(name string) error {
+	return WithHostNS(func() error {
+		return ops.RemoveLink(name)
+	})
+}
+
+// AttachTapToBridge creates a tap device in the host namespace, owned by the
+// jailed VM's user, and enslaves it to the bridge.
+func (ops *defaultNetlinkOps) AttachTapToBridge(bridgeName string, tapName string, mtu int, ownerUID int, ownerGID int) error {
+	return WithHostNS(func() error {
+		return ops.attachTapToBridge(bridgeName, tapName, mtu, ownerUID, ownerGID)
+	})
+}
+
+func (ops *defaultNetlinkOps) attachTapToBridge(bridgeName string, tapName string, mtu int, ownerUID int, ownerGID int) error {
+	bridge, err := ops.GetLink(bridgeName)
+	if err != nil {
+		return err
+	}
+	tap, err := createTap(tapName, mtu, ownerUID, ownerGID)
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetMaster(tap, bridge); err != nil {
+		netlink.LinkDel(tap)
+		return fmt.Errorf("failed to attach %s to bridge %s: %w", tapName, bridgeName, permissionError(err))
+	}
+	return nil
+}
+
+// EnableMasquerade lets a VM on the bridge reach the outside world: it turns
+// on forwarding and source NATs traffic from the VM's addresses that leaves
+// through any interface other than the bridge. The rules are tagged with
+// owner, e.g. the VM's tap, and calling it again for the same owner replaces
+// its rules only, the rules of the other VMs on the bridge are kept.
+func (ops *defaultNetlinkOps) EnableMasquerade(bridgeName string, owner string, sources []net.IPNet) error {
+	return WithHostNS(func() error {
+		return ops.enableMasquerade(bridgeName, owner, sources)
+	})
+}
+
+func (ops *defaultNetlinkOps) enableMasquerade(bridgeName string, owner string, sources []net.IPNet) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	if err := delMasqueradeRules(conn, bridgeName, owner); err != nil {
+		return err
+	}
+
+	tables := map[nftables.TableFamily]*nftables.Table{}
+	chains := map[nftables.TableFamily]*nftables.Chain{}
+	for _, source := range sources {
+		family, sysctl := nftables.TableFamilyIPv6, "/proc/sys/net/ipv6/conf/all/forwarding"
+		offset, ip := uint32(8), source.IP.To16()
+		if ip4 := source.IP.To4(); ip4 != nil {
+			family, sysctl = nftables.TableFamilyIPv4, "/proc/sys/net/ipv4/ip_forward"
+			offset, ip = 12, ip4
+		}
+		if err := os.WriteFile(sysctl, []byte("1"), 0644); err != nil {
+			return fmt.Errorf("failed to enable forwarding: %w", permissionError(err))
+		}
+
+		// adding an existing table or chain is a no-op
+		if _, ok := tables[family]; !ok {
+			tables[family] = conn.AddTable(&nftables.Table{Family: family, Name: natTableName(bridgeName)})
+			chains[family] = conn.AddChain(natChain(tables[family]))
+		}
+
+		// ip saddr $SOURCE oifname != $BRIDGE masquerade
+		size := uint32(len(ip))
+		conn.AddRule(&nftables.Rule{
+			Table:    tables[family],
+			Chain:    chains[family],
+			UserData: []byte(owner),
+			Exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: size, Mask: source.Mask, Xor: make([]byte, size)},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(source.Mask)},
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifname(bridgeName)},
+				&expr.Masq{},
+			},
+		})
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to program masquerade for %s: %w", bridgeName, permissionError(err))
+	}
+	logs.Logger.Infof("Enabled masquerade for %s on bridge %s", owner, bridgeName)
+	return nil
+}
+
+// RemoveMasquerade removes the NAT rules EnableMasquerade added for owner.
+func (ops *defaultNetlinkOps) RemoveMasquerade(bridgeName string, owner string) error {
+	return WithHostNS(func() error {
+		return ops.removeMasquerade(bridgeName, owner)
+	})
+}
+
+func (ops *defaultNetlinkOps) removeMasquerade(bridgeName string, owner string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	if err := delMasqueradeRules(conn, bridgeName, owner); err != nil {
+		return err
+	}
+	return permissionError(conn.Flush())
+}
+
+// DisableMasquerade removes the NAT rules of all VMs on the bridge.
+// Forwarding is left enabled as other users of the host may rely on it.
+func (ops *defaultNetlinkOps) DisableMasquerade(bridgeName string) error {
+	return WithHostNS(func() error {
+		return ops.disableMasquerade(bridgeName)
+	})
+}
+
+func (ops *defaultNetlinkOps) disableMasquerade(bridgeName string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return err
+	}
+	if err := delNATTables(conn, bridgeName); err != nil {
+		return err
+	}
+	return conn.Flush()
+}
+
+func natChain(table *nftables.Table) *nftables.Chain {
+	return &nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	}
+}
+
+// delMasqueradeRules queues the deletion of owner's rules on conn.
+func delMasqueradeRules(conn *nftables.Conn, bridgeName string, owner string) error {
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		tables, err := conn.ListTablesOfFamily(family)
+		if err != nil {
+			return fmt.Errorf("failed to list nftables tables: %w", err)
+		}
+		for _, t := range tables {
+			if t.Name != natTableName(bridgeName) {
+				continue
+			}
+			rules, err := conn.GetRules(t, natChain(t))
+			if err != nil {
+				return fmt.Errorf("failed to list masquerade rules of %s: %w", bridgeName, err)
+			}
+			for _, r := range rules {
+				if string(r.UserData) == owner {
+					if err := conn.DelRule(r); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func natTableName(bridgeName string) string {
+	return "firetest-nat-" + bridgeName
+}
+
+func delNATTables(conn *nftables.Conn, bridgeName string) error {
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		tables, err := conn.ListTablesOfFamily(family)
+		if err != nil {
+			return fmt.Errorf("failed to list nftables tables: %w", err)
+		}
+		for _, t := range tables {
+			if t.Name == natTableName(bridgeName) {
+				conn.DelTable(t)
+			}
+		}
+	}
+	return nil
+}
+
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
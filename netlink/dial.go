@@ -0,0 +1,103 @@
+package netlink
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// DialContextInNS connects to addr from inside the namespace at nsPath, e.g.
+// to health check a guest that is only reachable there. Only the socket is
+// created in the namespace, on a thread locked to it that holds no
+// capabilities while dialing; the returned connection is an ordinary
+// net.Conn usable from any goroutine. Host names and service names are
+// resolved in the host namespace before entering the sandbox, and the
+// addresses are tried in order.
+func DialContextInNS(ctx context.Context, nsPath string, network string, addr string) (net.Conn, error) {
+	addrs, err := resolve(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	// without fast fallback the dialer connects on the calling goroutine
+	// instead of racing address families on goroutines outside the namespace
+	d := net.Dialer{FallbackDelay: -1}
+	var conn net.Conn
+	var dialErrs []error
+	if err := withNetNS(ns, false, func() error {
+		for _, a := range addrs {
+			c, err := d.DialContext(ctx, network, a)
+			if err == nil {
+				conn = c
+				return nil
+			}
+			dialErrs = append(dialErrs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, errors.Join(dialErrs...)
+	}
+	return conn, nil
+}
+
+// resolve turns addr into the IP addresses and port to dial.
+func resolve(ctx context.Context, network string, addr string) ([]string, error) {
+	host, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, network, service)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		// dials the local system, like net.Dial
+		return []string{net.JoinHostPort("", strconv.Itoa(port))}, nil
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []string{netip.AddrPortFrom(ip, uint16(port)).String()}, nil
+	}
+	family := "ip"
+	switch {
+	case strings.HasSuffix(network, "4"):
+		family = "ip4"
+	case strings.HasSuffix(network, "6"):
+		family = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, family, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = netip.AddrPortFrom(ip.Unmap(), uint16(port)).String()
+	}
+	return addrs, nil
+}
+
+// NewNSTransport returns an http.Transport that dials every connection inside
+// the namespace at nsPath. It ignores the host's proxy settings, proxies are
+// not reachable from the sandbox.
+func NewNSTransport(nsPath string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return DialContextInNS(ctx, nsPath, network, addr)
+	}
+	return t
+}
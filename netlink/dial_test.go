@@ -0,0 +1,90 @@
+package netlink
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		network, addr string
+		want          []string
+	}{
+		{"tcp", "10.0.0.2:80", []string{"10.0.0.2:80"}},
+		{"tcp", "[fd00::2]:http", []string{"[fd00::2]:80"}},
+		{"tcp4", "localhost:8080", []string{"127.0.0.1:8080"}},
+		{"tcp", ":22", []string{":22"}},
+	}
+	for _, tt := range tests {
+		got, err := resolve(context.Background(), tt.network, tt.addr)
+		if err != nil {
+			t.Errorf("resolve(%s, %s) failed: %v", tt.network, tt.addr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("resolve(%s, %s) = %q, want %q", tt.network, tt.addr, got, tt.want)
+		}
+	}
+	if _, err := resolve(context.Background(), "tcp", "10.0.0.2"); err == nil {
+		t.Error("resolve() accepted an address without port")
+	}
+}
+
+func TestDialContextInNS(t *testing.T) {
+	ns := newNS(t)
+	// a listener on the loopback of the sandbox, unreachable from the host
+	var listener net.Listener
+	if err := WithNetNS(ns, func() error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(lo); err != nil {
+			return err
+		}
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "hello")
+	}()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	before, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := DialContextInNS(ctx, nsPath(ns), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf, err := io.ReadAll(conn)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+	if cur, err := netns.Get(); err != nil || !cur.Equal(before) {
+		t.Error("the calling thread changed namespace")
+	}
+}
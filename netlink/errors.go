@@ -0,0 +1,75 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Errors returned by NetlinkOps and the namespace helpers, match them with
+// errors.Is. They wrap the underlying error, so errors.Is(err, unix.EPERM)
+// and the like keep working.
+var (
+	ErrNamespaceNotFound = errors.New("network namespace not found")
+	ErrLinkNotFound      = errors.New("link not found")
+	ErrLinkExists        = errors.New("link already exists")
+	ErrPermission        = errors.New("insufficient privileges")
+	// ErrHostNamespace is returned for a sandbox namespace that is the
+	// namespace of the process itself.
+	ErrHostNamespace = errors.New("namespace is the host namespace")
+)
+
+// LinkNotFoundError names the missing link, it matches ErrLinkNotFound.
+type LinkNotFoundError struct {
+	device string
+}
+
+func (e *LinkNotFoundError) Error() string {
+	return fmt.Sprintf("did not find expected network device with name %q", e.device)
+}
+
+func (e *LinkNotFoundError) Is(target error) bool {
+	return target == ErrLinkNotFound
+}
+
+// linkError classifies the error of an operation on the link name.
+func linkError(err error, name string) error {
+	if err == nil {
+		return nil
+	}
+	var notFound netlink.LinkNotFoundError
+	switch {
+	case errors.As(err, &notFound), errors.Is(err, unix.ENODEV):
+		return &LinkNotFoundError{device: name}
+	case errors.Is(err, unix.EEXIST):
+		return fmt.Errorf("%w: %s: %w", ErrLinkExists, name, err)
+	}
+	return permissionError(err)
+}
+
+// permissionError marks errors caused by missing privileges, e.g. the
+// CAP_NET_ADMIN capability.
+func permissionError(err error) error {
+	if err == nil || errors.Is(err, ErrPermission) {
+		return err
+	}
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES) {
+		return fmt.Errorf("%w: %w", ErrPermission, err)
+	}
+	return err
+}
+
+// getNS opens the namespace at path.
+func getNS(path string) (netns.NsHandle, error) {
+	ns, err := netns.GetFromPath(path)
+	if err == nil {
+		return ns, nil
+	}
+	if errors.Is(err, unix.ENOENT) {
+		return ns, fmt.Errorf("%w: %s: %w", ErrNamespaceNotFound, path, err)
+	}
+	return ns, fmt.Errorf("failed to open namespace %s: %w", path, permissionError(err))
+}
@@ -0,0 +1,63 @@
+package netlink
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestLinkError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		match []error
+	}{
+		{"library not found", netlink.LinkNotFoundError{}, []error{ErrLinkNotFound}},
+		{"ENODEV", unix.ENODEV, []error{ErrLinkNotFound}},
+		{"EEXIST", unix.EEXIST, []error{ErrLinkExists, unix.EEXIST}},
+		{"EPERM", unix.EPERM, []error{ErrPermission, unix.EPERM}},
+		{"EACCES", unix.EACCES, []error{ErrPermission, unix.EACCES}},
+	}
+	for _, tt := range tests {
+		err := linkError(tt.err, "tap0")
+		for _, target := range tt.match {
+			if !errors.Is(err, target) {
+				t.Errorf("%s: linkError() = %v, want it to match %v", tt.name, err, target)
+			}
+		}
+	}
+
+	var notFound *LinkNotFoundError
+	if err := linkError(unix.ENODEV, "tap0"); !errors.As(err, &notFound) || notFound.device != "tap0" {
+		t.Errorf("linkError() = %v, want a *LinkNotFoundError for tap0", err)
+	}
+	if err := linkError(nil, "tap0"); err != nil {
+		t.Errorf("linkError(nil) = %v", err)
+	}
+	if err := linkError(unix.EINVAL, "tap0"); !errors.Is(err, unix.EINVAL) || errors.Is(err, ErrPermission) {
+		t.Errorf("linkError(EINVAL) = %v, want it unclassified", err)
+	}
+}
+
+func TestPermissionErrorWrapsOnce(t *testing.T) {
+	err := permissionError(permissionError(unix.EPERM))
+	if want := "insufficient privileges: operation not permitted"; err.Error() != want {
+		t.Errorf("permissionError() = %q, want %q", err, want)
+	}
+}
+
+func TestGetNSNotFound(t *testing.T) {
+	_, err := getNS("/proc/self/ns/does-not-exist")
+	if !errors.Is(err, ErrNamespaceNotFound) || !errors.Is(err, unix.ENOENT) {
+		t.Errorf("getNS() = %v, want %v wrapping ENOENT", err, ErrNamespaceNotFound)
+	}
+}
+
+func TestAttachTapHostNamespace(t *testing.T) {
+	err := DefaultNetlinkOps().AttachTap(HostNSPath, "tap0", 1500, 0, 0)
+	if !errors.Is(err, ErrHostNamespace) {
+		t.Errorf("AttachTap() = %v, want %v", err, ErrHostNamespace)
+	}
+}
@@ -0,0 +1,82 @@
+package netlink
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// AddTcLocalDelivery exempts IPv4 and IPv6 packets to dport arriving on iface
+// from the tc redirect, so they stay in the sandbox namespace instead of
+// leaving through the uplink: they reach a service listening there, such as
+// the guest's DHCP server, or are dropped by its stack after the DNS proxy
+// captured them.
+func (ops *defaultNetlinkOps) AddTcLocalDelivery(nsPath string, iface string, proto uint8, dport uint16) error {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	return WithNetNS(ns, func() error {
+		link, err := ops.GetLink(iface)
+		if err != nil {
+			return err
+		}
+		if err := addIngressQdisc(link); err != nil {
+			return err
+		}
+		if err := addLocalFilter(link, localFilterPriority, syscall.ETH_P_IP, ipv4LocalKeys(proto, dport)); err != nil {
+			return err
+		}
+		return addLocalFilter(link, localFilterPriority6, syscall.ETH_P_IPV6, ipv6LocalKeys(proto, dport))
+	})
+}
+
+// u32 match ip protocol $PROTO 0xff match ip dport $DPORT 0xffff
+//
+// The port match assumes an IP header without options, which holds for the
+// DHCP and DNS traffic of the guest.
+func ipv4LocalKeys(proto uint8, dport uint16) []netlink.TcU32Key {
+	return []netlink.TcU32Key{
+		{Mask: 0x00ff0000, Val: uint32(proto) << 16, Off: 8},
+		{Mask: 0x0000ffff, Val: uint32(dport), Off: 20},
+	}
+}
+
+// u32 match ip6 protocol $PROTO 0xff match ip6 dport $DPORT 0xffff
+//
+// The port match assumes no extension headers.
+func ipv6LocalKeys(proto uint8, dport uint16) []netlink.TcU32Key {
+	return []netlink.TcU32Key{
+		{Mask: 0x0000ff00, Val: uint32(proto) << 8, Off: 4},
+		{Mask: 0x0000ffff, Val: uint32(dport), Off: 40},
+	}
+}
+
+// tc filter add dev $IFACE parent ffff: prio $PRIO
+// protocol $PROTOCOL
+// u32 $KEYS
+// flowid 1:1
+func addLocalFilter(link netlink.Link, prio uint16, protocol uint16, keys []netlink.TcU32Key) error {
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0),
+			Priority:  prio,
+			Protocol:  protocol,
+		},
+		Sel: &netlink.TcU32Sel{
+			Flags: netlink.TC_U32_TERMINAL,
+			Keys:  keys,
+		},
+		// a match without actions ends the filter chain with TC_ACT_OK,
+		// which needs no action module unlike "action pass"
+		ClassId: netlink.MakeHandle(1, 1),
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to add local delivery filter to %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package netlink
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// MTUExceedsParentError is returned when a tap is asked for a larger MTU than
+// the link its traffic leaves through, which would silently drop the guest's
+// large packets.
+type MTUExceedsParentError struct {
+	Iface     string
+	MTU       int
+	Parent    string
+	ParentMTU int
+}
+
+func (e *MTUExceedsParentError) Error() string {
+	return fmt.Sprintf("MTU %d of %s exceeds MTU %d of its parent %s", e.MTU, e.Iface, e.ParentMTU, e.Parent)
+}
+
+// LinkMTU returns the MTU of iface inside the namespace at nsPath.
+func (ops *defaultNetlinkOps) LinkMTU(nsPath string, iface string) (int, error) {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return 0, err
+	}
+	defer ns.Close()
+
+	var mtu int
+	err = WithNetNS(ns, func() error {
+		link, err := netlink.LinkByName(iface)
+		if err != nil {
+			return linkError(err, iface)
+		}
+		mtu = link.Attrs().MTU
+		return nil
+	})
+	return mtu, err
+}
+
+// TapMTU picks the MTU of tapName, whose traffic leaves through parent in the
+// namespace at nsPath. A zero mtu inherits the parent's MTU, so taps paired
+// with overlay network veths get e.g. 1450 instead of 1500.
+func (ops *defaultNetlinkOps) TapMTU(nsPath string, parent string, tapName string, mtu int) (int, error) {
+	parentMTU, err := ops.LinkMTU(nsPath, parent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read MTU of %s: %w", parent, err)
+	}
+	if mtu == 0 {
+		return parentMTU, nil
+	}
+	if mtu > parentMTU {
+		return 0, &MTUExceedsParentError{Iface: tapName, MTU: mtu, Parent: parent, ParentMTU: parentMTU}
+	}
+	return mtu, nil
+}
@@ -2,22 +2,48 @@ package netlink
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"syscall"
 
 	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
 	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/sys/unix"
 )
 
 var MainInterface = "eth0"
 
+// Filter priorities on the ingress qdisc, lower runs first. Filters sharing
+// a priority must match the same protocol.
+const (
+	policeFilterPriority   = 1
+	localFilterPriority    = 5
+	localFilterPriority6   = 6
+	redirectFilterPriority = 10
+)
+
 // Netlink Operations
 type NetlinkOps interface {
 	GetLink(name string) (netlink.Link, error)
 	RemoveLink(name string) error
 	AttachTap(nsPath string, tapName string, mtu int, ownerUID int, ownerGID int) error
 	AddTcRedirect(nsPath string, ethIface string, tuntapIface string) error
+	AddTcRedirectFrom(nsPath string, srcIface string, dstIface string) error
+	SetBandwidth(nsPath string, iface string, bw Bandwidth) error
+	ClearBandwidth(nsPath string, iface string) error
+	QdiscList(nsPath string, iface string) ([]netlink.Qdisc, error)
+	ClassList(nsPath string, iface string) ([]netlink.Class, error)
+	EnsureBridge(name string, gateways []net.IPNet) error
+	RemoveBridge(name string) error
+	AttachTapToBridge(bridgeName string, tapName string, mtu int, ownerUID int, ownerGID int) error
+	EnableMasquerade(bridgeName string, owner string, sources []net.IPNet) error
+	RemoveMasquerade(bridgeName string, owner string) error
+	DisableMasquerade(bridgeName string) error
+	LinkMTU(nsPath string, iface string) (int, error)
+	TapMTU(nsPath string, parent string, tapName string, mtu int) (int, error)
+	AddTcLocalDelivery(nsPath string, iface string, proto uint8, dport uint16) error
+	LinkByAddr(nsPath string, mac string, ips []net.IP) (string, error)
 }
 
 type defaultNetlinkOps struct {
@@ -28,7 +54,7 @@ func DefaultNetlinkOps() NetlinkOps {
 }
 
 func (ops *defaultNetlinkOps) AddTcRedirect(nsPath string, ethIface string, tuntapIface string) error {
-	ns, err := netns.GetFromPath(nsPath)
+	ns, err := getNS(nsPath)
 	if err != nil {
 		return err
 	}
@@ -67,10 +93,39 @@ func (ops *defaultNetlinkOps) AddTcRedirect(nsPath string, ethIface string, tunt
 	})
 }
 
+// AddTcRedirectFrom only redirects the traffic arriving on srcIface to
+// dstIface, leaving the opposite direction to another datapath such as the
+// sandbox firewall.
+func (ops *defaultNetlinkOps) AddTcRedirectFrom(nsPath string, srcIface string, dstIface string) error {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	return WithNetNS(ns, func() error {
+		src, err := ops.GetLink(srcIface)
+		if err != nil {
+			return err
+		}
+		dst, err := ops.GetLink(dstIface)
+		if err != nil {
+			return err
+		}
+		if err := addIngressQdisc(src); err != nil {
+			return err
+		}
+		if err := addIngressQdisc(dst); err != nil {
+			return err
+		}
+		return addRedirectFilter(src, dst)
+	})
+}
+
 func (ops defaultNetlinkOps) GetLink(name string) (netlink.Link, error) {
 	link, err := netlink.LinkByName(name)
-	if _, ok := err.(netlink.LinkNotFoundError); ok {
-		return nil, &LinkNotFoundError{device: name}
+	if err != nil {
+		return nil, linkError(err, name)
 	}
 	return link, nil
 }
@@ -80,16 +135,61 @@ func (ops defaultNetlinkOps) RemoveLink(name string) error {
 	if err != nil {
 		return err
 	}
-	err = netlink.LinkDel(link)
-	if _, ok := err.(netlink.LinkNotFoundError); ok {
-		return &LinkNotFoundError{device: link.Attrs().Name}
+	return linkError(netlink.LinkDel(link), name)
+}
+
+// LinkByAddr returns the name of the link inside the namespace at nsPath
+// with the hardware address mac, or, if mac is empty, holding one of ips.
+func (ops *defaultNetlinkOps) LinkByAddr(nsPath string, mac string, ips []net.IP) (string, error) {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return "", err
 	}
-	return err
+	defer ns.Close()
+
+	var name string
+	err = WithNetNS(ns, func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return permissionError(err)
+		}
+		for _, link := range links {
+			if mac != "" {
+				if strings.EqualFold(link.Attrs().HardwareAddr.String(), mac) {
+					name = link.Attrs().Name
+					return nil
+				}
+				continue
+			}
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				return permissionError(err)
+			}
+			for _, addr := range addrs {
+				for _, ip := range ips {
+					if addr.IP.Equal(ip) {
+						name = link.Attrs().Name
+						return nil
+					}
+				}
+			}
+		}
+		if mac != "" {
+			return fmt.Errorf("%w: no link has address %s", ErrLinkNotFound, mac)
+		}
+		return fmt.Errorf("%w: no link has one of the addresses %v", ErrLinkNotFound, ips)
+	})
+	return name, err
 }
 
-// Add Ip addresses to the interface in the process namespace.
+// Add Ip addresses to the interface in the process namespace. IPv6 addresses
+// skip duplicate address detection so statically assigned addresses are
+// usable right away, there is no router advertisement to wait for.
 func (ops *defaultNetlinkOps) AddLinkIP(iface netlink.Link, ipAddr netlink.Addr) error {
 	logs.Logger.Info("Adding Address")
+	if ipAddr.IP.To4() == nil {
+		ipAddr.Flags |= unix.IFA_F_NODAD
+	}
 	if err := netlink.AddrAdd(iface, &ipAddr); err != nil {
 		logs.Logger.Errorf("Error Adding Ip address: %s to the interface: %s", iface.Attrs().Name, ipAddr.String())
 		return err
@@ -114,7 +214,7 @@ func addIngressQdisc(link netlink.Link) error {
 	return nil
 }
 
-// tc filter add dev $SRC_IFACE parent ffff:
+// tc filter add dev $SRC_IFACE parent ffff: prio 10
 // protocol all
 // u32 match u32 0 0
 // action mirred egress mirror dev $DST_IFACE
@@ -123,6 +223,7 @@ func addRedirectFilter(linkSrc, linkDest netlink.Link) error {
 		FilterAttrs: netlink.FilterAttrs{
 			LinkIndex: linkSrc.Attrs().Index,
 			Parent:    netlink.MakeHandle(0xffff, 0),
+			Priority:  redirectFilterPriority,
 			Protocol:  syscall.ETH_P_ALL,
 		},
 		Actions: []netlink.Action{
@@ -137,11 +238,3 @@ func addRedirectFilter(linkSrc, linkDest netlink.Link) error {
 	}
 	return netlink.FilterAdd(filter)
 }
-
-type LinkNotFoundError struct {
-	device string
-}
-
-func (e LinkNotFoundError) Error() string {
-	return fmt.Sprintf("did not find expected network device with name %q", e.device)
-}
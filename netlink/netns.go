@@ -8,30 +8,114 @@ import (
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
-)
+	"github.com/weaveworks/ignite/pkg/logs"
 
-var ErrLinkNotFound = errors.New("Link not found")
+	"ranjankuldeep/test/privilege"
+)
 
-// WithNetNS switches to the given namespace, executes the provided function, and then switches back.
-func WithNetNS(ns netns.NsHandle, work func() error) error {
-	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
+// HostNSPath is the namespace the process started in. /proc/self names the
+// namespace of the main thread, which may have been left in a sandbox, so the
+// namespace is held open from init, before any thread switched, and named by
+// its file descriptor.
+var HostNSPath = hostNSPath()
 
-	oldNs, err := netns.Get()
+func hostNSPath() string {
+	ns, err := netns.Get()
 	if err != nil {
-		return fmt.Errorf("failed to get current namespace: %w", err)
+		logs.Logger.Errorf("Failed to get host namespace: %v", err)
+		return "/proc/thread-self/ns/net"
 	}
-	defer oldNs.Close()
+	return fmt.Sprintf("/proc/self/fd/%d", int(ns))
+}
 
-	if err := netns.Set(ns); err != nil {
-		return fmt.Errorf("failed to set namespace: %w", err)
-	}
-	defer netns.Set(oldNs)
+// WithNetNS executes the provided function inside the given namespace. The
+// work runs on a dedicated goroutine locked to its OS thread, so the caller's
+// thread never changes namespace, with the capabilities of privilege.Network
+// raised on that thread only. If the thread cannot be switched back to its
+// original namespace or drop the capabilities it is left locked when the
+// goroutine exits, which makes the Go runtime terminate it rather than hand
+// it to other goroutines.
+func WithNetNS(ns netns.NsHandle, work func() error) error {
+	return withNetNS(ns, true, work)
+}
 
-	if err := work(); err != nil {
-		return fmt.Errorf("error executing work function in namespace: %w", err)
-	}
+// withNetNS runs work like WithNetNS. Unless privileged, the capabilities
+// are only raised to switch namespaces and dropped while work runs.
+func withNetNS(ns netns.NsHandle, privileged bool, work func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		restore, err := privilege.Raise(privilege.Network)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("%w: %w", ErrPermission, err)
+			return
+		}
+
+		oldNs, err := netns.Get()
+		if err != nil {
+			errCh <- errors.Join(fmt.Errorf("failed to get current namespace: %w", err), restoreCaps(restore))
+			return
+		}
+		defer oldNs.Close()
 
+		if err := netns.Set(ns); err != nil {
+			errCh <- errors.Join(fmt.Errorf("failed to set namespace: %w", permissionError(err)), restoreCaps(restore))
+			return
+		}
+
+		if !privileged {
+			if err := restore(); err != nil {
+				// the thread is stuck in ns, keep it locked so it dies with us
+				logs.Logger.Errorf("Failed to drop capabilities, discarding thread: %v", err)
+				errCh <- err
+				return
+			}
+		}
+
+		workErr := work()
+
+		if !privileged {
+			if restore, err = privilege.Raise(privilege.Network); err != nil {
+				logs.Logger.Errorf("Failed to raise capabilities to restore namespace, discarding thread: %v", err)
+				errCh <- errors.Join(workErr, err)
+				return
+			}
+		}
+
+		if err := netns.Set(oldNs); err != nil {
+			// the thread is stuck in ns, keep it locked so it dies with us
+			logs.Logger.Errorf("Failed to restore namespace, discarding thread: %v", err)
+			if workErr != nil {
+				errCh <- fmt.Errorf("failed to restore namespace: %v (work function failed with: %w)", err, workErr)
+				return
+			}
+			errCh <- fmt.Errorf("failed to restore namespace: %w", err)
+			return
+		}
+		if err := restoreCaps(restore); err != nil {
+			errCh <- errors.Join(workErr, err)
+			return
+		}
+
+		if workErr != nil {
+			errCh <- fmt.Errorf("error executing work function in namespace: %w", permissionError(workErr))
+			return
+		}
+		errCh <- nil
+	}()
+	return <-errCh
+}
+
+// restoreCaps drops the capabilities WithNetNS raised and unlocks the
+// thread, unless they are still raised.
+func restoreCaps(restore func() error) error {
+	if err := restore(); err != nil {
+		logs.Logger.Errorf("Failed to drop capabilities, discarding thread: %v", err)
+		return err
+	}
+	runtime.UnlockOSThread()
 	return nil
 }
 
@@ -39,23 +123,27 @@ func WithNetNSLink(ns netns.NsHandle, ifName string, work func(link netlink.Link
 	return WithNetNS(ns, func() error {
 		link, err := netlink.LinkByName(ifName)
 		if err != nil {
-			if err.Error() == errors.New("Link not found").Error() {
-				return ErrLinkNotFound
-			}
-			return err
+			return linkError(err, ifName)
 		}
 		return work(link)
 	})
 }
 
 func WithNetNSByPath(path string, work func() error) error {
-	ns, err := netns.GetFromPath(path)
+	ns, err := getNS(path)
 	if err != nil {
 		return err
 	}
+	defer ns.Close()
 	return WithNetNS(ns, work)
 }
 
+// WithHostNS runs work in the host namespace with the privileges of
+// WithNetNS, for the bridge, its taps and masquerade rules.
+func WithHostNS(work func() error) error {
+	return WithNetNSByPath(HostNSPath, work)
+}
+
 func NSPathByPid(pid int) string {
 	return NSPathByPidWithProc("/proc", pid)
 }
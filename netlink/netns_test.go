@@ -0,0 +1,125 @@
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/privilege"
+)
+
+// newNS creates a network namespace without moving the calling thread.
+func newNS(t *testing.T) netns.NsHandle {
+	t.Helper()
+	if err := privilege.Check(privilege.Network); err != nil {
+		t.Skip(err)
+	}
+	errCh := make(chan error, 1)
+	var ns netns.NsHandle
+	go func() {
+		runtime.LockOSThread()
+		orig, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		defer orig.Close()
+		if ns, err = netns.New(); err != nil {
+			errCh <- err
+			return
+		}
+		if err := netns.Set(orig); err != nil {
+			errCh <- err
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- nil
+	}()
+	if err := <-errCh; err != nil {
+		t.Skipf("cannot create network namespaces: %v", err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	return ns
+}
+
+// nsPath names the open namespace ns.
+func nsPath(ns netns.NsHandle) string {
+	return fmt.Sprintf("/proc/self/fd/%d", int(ns))
+}
+
+func TestWithNetNS(t *testing.T) {
+	ns := newNS(t)
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	caller, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	var tid int
+	var effective uint64
+	if err := WithNetNS(ns, func() error {
+		tid = unix.Gettid()
+		cur, err := netns.Get()
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+		if !cur.Equal(ns) {
+			return errors.New("work does not run in the namespace")
+		}
+		effective, err = privilege.Effective()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range privilege.Network.Caps {
+		if effective&(1<<uint(c)) == 0 {
+			t.Errorf("%s is not raised during the work", c)
+		}
+	}
+	if tid == unix.Gettid() {
+		t.Error("work ran on the calling thread")
+	}
+	if cur, err := netns.Get(); err != nil || !cur.Equal(caller) {
+		t.Error("the calling thread changed namespace")
+	}
+	// the thread may have exited, otherwise it is back in the host namespace
+	thread, err := netns.GetFromPath(fmt.Sprintf("/proc/self/task/%d/ns/net", tid))
+	if err == nil {
+		defer thread.Close()
+		if !thread.Equal(caller) {
+			t.Error("the thread of the work was not switched back")
+		}
+	}
+}
+
+func TestWithNetNSWorkError(t *testing.T) {
+	ns := newNS(t)
+	errWork := errors.New("work failed")
+	err := WithNetNS(ns, func() error { return errWork })
+	if !errors.Is(err, errWork) {
+		t.Errorf("WithNetNS() = %v, want it to wrap %v", err, errWork)
+	}
+	err = WithNetNS(ns, func() error { return unix.EPERM })
+	if !errors.Is(err, ErrPermission) {
+		t.Errorf("WithNetNS() = %v, want it to match %v", err, ErrPermission)
+	}
+}
+
+func TestWithNetNSByPathNotFound(t *testing.T) {
+	err := WithNetNSByPath("/proc/self/ns/does-not-exist", func() error {
+		t.Error("work ran without a namespace")
+		return nil
+	})
+	if !errors.Is(err, ErrNamespaceNotFound) {
+		t.Errorf("WithNetNSByPath() = %v, want %v", err, ErrNamespaceNotFound)
+	}
+}
@@ -0,0 +1,259 @@
+package netlink
+
+import (
+	"fmt"
+	"math"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/ignite/pkg/logs"
+)
+
+// ShapingQdisc selects the root qdisc used to shape egress traffic.
+type ShapingQdisc string
+
+const (
+	QdiscTBF ShapingQdisc = "tbf"
+	QdiscHTB ShapingQdisc = "htb"
+)
+
+const (
+	shapingHandleMajor = 1
+	shapingLatency     = 50 * time.Millisecond
+	minBurst           = 32 * 1024
+)
+
+// RateLimit is a rate in bytes per second and the burst in bytes allowed on
+// top of it. A zero burst defaults to 100ms worth of traffic.
+type RateLimit struct {
+	Rate  uint64
+	Burst uint32
+}
+
+func (r RateLimit) burst() uint32 {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	burst := r.Rate / 10
+	if burst < minBurst {
+		burst = minBurst
+	}
+	if burst > math.MaxUint32 {
+		burst = math.MaxUint32
+	}
+	return uint32(burst)
+}
+
+// Bandwidth is the host enforced shaping of one interface. Directions are
+// seen from the interface: on a tap device Egress is traffic delivered to the
+// guest and Ingress is traffic sent by the guest. A zero rate leaves that
+// direction unshaped.
+type Bandwidth struct {
+	// Qdisc used for egress shaping, defaults to tbf.
+	Qdisc   ShapingQdisc
+	Egress  RateLimit
+	Ingress RateLimit
+}
+
+// SetBandwidth shapes egress with a tbf or htb root qdisc and polices ingress
+// with a police action evaluated before the tc redirect filters. Calling it
+// again replaces the previous settings.
+func (ops *defaultNetlinkOps) SetBandwidth(nsPath string, iface string, bw Bandwidth) error {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	return WithNetNS(ns, func() error {
+		link, err := ops.GetLink(iface)
+		if err != nil {
+			return err
+		}
+		if err := removeEgressShaping(link); err != nil {
+			return err
+		}
+		if bw.Egress.Rate > 0 {
+			logs.Logger.Infof("Shaping egress of %s to %d bytes/s with %s", iface, bw.Egress.Rate, bw.Qdisc)
+			if err := addEgressShaping(link, bw.Qdisc, bw.Egress); err != nil {
+				return err
+			}
+		}
+		if err := removeIngressPolicing(link); err != nil {
+			return err
+		}
+		if bw.Ingress.Rate > 0 {
+			logs.Logger.Infof("Policing ingress of %s to %d bytes/s", iface, bw.Ingress.Rate)
+			if err := addIngressPolicing(link, bw.Ingress); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ClearBandwidth removes the shaping installed by SetBandwidth and leaves the
+// tc redirect filters untouched.
+func (ops *defaultNetlinkOps) ClearBandwidth(nsPath string, iface string) error {
+	return ops.SetBandwidth(nsPath, iface, Bandwidth{})
+}
+
+// QdiscList returns the qdiscs of the interface, including their statistics.
+func (ops *defaultNetlinkOps) QdiscList(nsPath string, iface string) ([]netlink.Qdisc, error) {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	var qdiscs []netlink.Qdisc
+	err = WithNetNS(ns, func() error {
+		link, err := ops.GetLink(iface)
+		if err != nil {
+			return err
+		}
+		qdiscs, err = netlink.QdiscList(link)
+		return err
+	})
+	return qdiscs, err
+}
+
+// ClassList returns the classes of the interface, including their statistics.
+func (ops *defaultNetlinkOps) ClassList(nsPath string, iface string) ([]netlink.Class, error) {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	var classes []netlink.Class
+	err = WithNetNS(ns, func() error {
+		link, err := ops.GetLink(iface)
+		if err != nil {
+			return err
+		}
+		classes, err = netlink.ClassList(link, netlink.HANDLE_NONE)
+		return err
+	})
+	return classes, err
+}
+
+// tc qdisc add dev $IFACE root handle 1: tbf rate $RATE burst $BURST latency 50ms
+// or
+// tc qdisc add dev $IFACE root handle 1: htb default 1
+// tc class add dev $IFACE parent 1: classid 1:1 htb rate $RATE burst $BURST
+func addEgressShaping(link netlink.Link, kind ShapingQdisc, limit RateLimit) error {
+	attrs := netlink.QdiscAttrs{
+		LinkIndex: link.Attrs().Index,
+		Handle:    netlink.MakeHandle(shapingHandleMajor, 0),
+		Parent:    netlink.HANDLE_ROOT,
+	}
+	burst := limit.burst()
+
+	switch kind {
+	case QdiscTBF, "":
+		queued := uint64(shapingLatency.Seconds()*float64(limit.Rate)) + uint64(burst)
+		if queued > math.MaxUint32 {
+			queued = math.MaxUint32
+		}
+		qdisc := &netlink.Tbf{
+			QdiscAttrs: attrs,
+			Rate:       limit.Rate,
+			Limit:      uint32(queued),
+			Buffer:     netlink.Xmittime(limit.Rate, burst),
+		}
+		if err := netlink.QdiscAdd(qdisc); err != nil {
+			return fmt.Errorf("failed to add tbf qdisc to %s: %w", link.Attrs().Name, err)
+		}
+	case QdiscHTB:
+		qdisc := netlink.NewHtb(attrs)
+		qdisc.Defcls = 1
+		if err := netlink.QdiscAdd(qdisc); err != nil {
+			return fmt.Errorf("failed to add htb qdisc to %s: %w", link.Attrs().Name, err)
+		}
+		class := netlink.NewHtbClass(netlink.ClassAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    attrs.Handle,
+			Handle:    netlink.MakeHandle(shapingHandleMajor, 1),
+		}, netlink.HtbClassAttrs{
+			Rate:    limit.Rate * 8,
+			Ceil:    limit.Rate * 8,
+			Buffer:  burst,
+			Cbuffer: burst,
+		})
+		if err := netlink.ClassAdd(class); err != nil {
+			return fmt.Errorf("failed to add htb class to %s: %w", link.Attrs().Name, err)
+		}
+	default:
+		return fmt.Errorf("unsupported shaping qdisc %q", kind)
+	}
+	return nil
+}
+
+func removeEgressShaping(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, qdisc := range qdiscs {
+		attrs := qdisc.Attrs()
+		if attrs.Parent != netlink.HANDLE_ROOT || attrs.Handle != netlink.MakeHandle(shapingHandleMajor, 0) {
+			continue
+		}
+		if err := netlink.QdiscDel(qdisc); err != nil {
+			return fmt.Errorf("failed to remove %s qdisc from %s: %w", qdisc.Type(), link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// tc filter add dev $IFACE parent ffff: prio 1
+// protocol all
+// u32 match u32 0 0
+// action police rate $RATE burst $BURST conform-exceed drop/continue
+func addIngressPolicing(link netlink.Link, limit RateLimit) error {
+	if limit.Rate > math.MaxUint32 {
+		return fmt.Errorf("ingress rate %d bytes/s exceeds the police action maximum", limit.Rate)
+	}
+	if err := addIngressQdisc(link); err != nil {
+		return err
+	}
+	police := netlink.NewPoliceAction()
+	police.Rate = uint32(limit.Rate)
+	police.Burst = limit.burst()
+	police.ExceedAction = netlink.TC_POLICE_SHOT
+	// continue with the next filter so conforming traffic still reaches the
+	// redirect filters
+	police.NotExceedAction = netlink.TC_POLICE_UNSPEC
+
+	filter := &netlink.U32{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.MakeHandle(0xffff, 0),
+			Priority:  policeFilterPriority,
+			Protocol:  syscall.ETH_P_ALL,
+		},
+		Actions: []netlink.Action{police},
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("failed to add police filter to %s: %w", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func removeIngressPolicing(link netlink.Link) error {
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		if filter.Attrs().Priority != policeFilterPriority {
+			continue
+		}
+		if err := netlink.FilterDel(filter); err != nil {
+			return fmt.Errorf("failed to remove police filter from %s: %w", link.Attrs().Name, err)
+		}
+	}
+	return nil
+}
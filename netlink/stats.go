@@ -0,0 +1,201 @@
+package netlink
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/ignite/pkg/logs"
+)
+
+// Counters are cumulative traffic counters since the interface or filter was
+// created.
+type Counters struct {
+	Bytes   uint64
+	Packets uint64
+	Drops   uint64
+}
+
+// RedirectCounters are the counters of a mirred redirect filter installed by
+// AddTcRedirect on the ingress of an interface.
+type RedirectCounters struct {
+	// Target is the interface the filter redirects to.
+	Target string
+	Counters
+}
+
+// InterfaceStats is a snapshot of an interface inside a sandbox namespace.
+type InterfaceStats struct {
+	Iface     string
+	Time      time.Time
+	RX        Counters
+	TX        Counters
+	Redirects []RedirectCounters
+}
+
+// Stats reads the link statistics of iface inside the namespace at nsPath and
+// the counters of the redirect filters attached to it. For a tap device RX is
+// what the guest sent and TX is what was delivered to it.
+func Stats(nsPath string, iface string) (*InterfaceStats, error) {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	var stats *InterfaceStats
+	err = WithNetNS(ns, func() error {
+		link, err := netlink.LinkByName(iface)
+		if err != nil {
+			return linkError(err, iface)
+		}
+		stats = &InterfaceStats{Iface: iface, Time: time.Now()}
+		if s := link.Attrs().Statistics; s != nil {
+			stats.RX = Counters{Bytes: s.RxBytes, Packets: s.RxPackets, Drops: s.RxDropped}
+			stats.TX = Counters{Bytes: s.TxBytes, Packets: s.TxPackets, Drops: s.TxDropped}
+		}
+		stats.Redirects, err = redirectCounters(link)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read statistics of %s: %w", iface, err)
+	}
+	return stats, nil
+}
+
+func redirectCounters(link netlink.Link) ([]RedirectCounters, error) {
+	filters, err := netlink.FilterList(link, netlink.MakeHandle(0xffff, 0))
+	if err != nil {
+		return nil, err
+	}
+	var counters []RedirectCounters
+	for _, filter := range filters {
+		u32, ok := filter.(*netlink.U32)
+		if !ok || filter.Attrs().Priority != redirectFilterPriority {
+			continue
+		}
+		for _, action := range u32.Actions {
+			mirred, ok := action.(*netlink.MirredAction)
+			if !ok {
+				continue
+			}
+			c := RedirectCounters{Target: fmt.Sprintf("if%d", mirred.Ifindex)}
+			if target, err := netlink.LinkByIndex(mirred.Ifindex); err == nil {
+				c.Target = target.Attrs().Name
+			}
+			if s := mirred.Attrs().Statistics; s != nil {
+				if s.Basic != nil {
+					c.Bytes = s.Basic.Bytes
+					c.Packets = uint64(s.Basic.Packets)
+				}
+				if s.Queue != nil {
+					c.Drops = uint64(s.Queue.Drops)
+				}
+			}
+			counters = append(counters, c)
+		}
+	}
+	return counters, nil
+}
+
+// Rates is the per second traffic of an interface between two samples.
+type Rates struct {
+	Iface    string
+	Interval time.Duration
+	RX       RateCounters
+	TX       RateCounters
+}
+
+type RateCounters struct {
+	BytesPerSec   float64
+	PacketsPerSec float64
+	DropsPerSec   float64
+}
+
+// RatesBetween computes the rates from prev to cur. Counters that went
+// backwards, e.g. because the interface was recreated, yield zero.
+func RatesBetween(prev, cur *InterfaceStats) Rates {
+	interval := cur.Time.Sub(prev.Time)
+	rates := Rates{Iface: cur.Iface, Interval: interval}
+	if interval <= 0 {
+		return rates
+	}
+	rates.RX = rateOf(prev.RX, cur.RX, interval)
+	rates.TX = rateOf(prev.TX, cur.TX, interval)
+	return rates
+}
+
+func rateOf(prev, cur Counters, interval time.Duration) RateCounters {
+	per := func(a, b uint64) float64 {
+		if b < a {
+			return 0
+		}
+		return float64(b-a) / interval.Seconds()
+	}
+	return RateCounters{
+		BytesPerSec:   per(prev.Bytes, cur.Bytes),
+		PacketsPerSec: per(prev.Packets, cur.Packets),
+		DropsPerSec:   per(prev.Drops, cur.Drops),
+	}
+}
+
+// Sampler turns successive Stats calls into rates.
+type Sampler struct {
+	nsPath string
+	iface  string
+	prev   *InterfaceStats
+}
+
+func NewSampler(nsPath string, iface string) *Sampler {
+	return &Sampler{nsPath: nsPath, iface: iface}
+}
+
+// Sample reads the current statistics and returns them with the rates since
+// the previous sample. The first call only establishes the baseline and
+// returns zero rates.
+func (s *Sampler) Sample() (*InterfaceStats, Rates, error) {
+	cur, err := Stats(s.nsPath, s.iface)
+	if err != nil {
+		return nil, Rates{}, err
+	}
+	prev := s.prev
+	s.prev = cur
+	if prev == nil {
+		return cur, Rates{Iface: s.iface}, nil
+	}
+	return cur, RatesBetween(prev, cur), nil
+}
+
+// Run samples every interval until ctx is done or sampling fails, e.g.
+// because the sandbox went away. The channel is closed when Run returns.
+func (s *Sampler) Run(ctx context.Context, interval time.Duration) <-chan Rates {
+	ch := make(chan Rates)
+	go func() {
+		defer close(ch)
+		if _, _, err := s.Sample(); err != nil {
+			logs.Logger.Errorf("Stopped sampling %s: %v", s.iface, err)
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			_, rates, err := s.Sample()
+			if err != nil {
+				logs.Logger.Errorf("Stopped sampling %s: %v", s.iface, err)
+				return
+			}
+			select {
+			case ch <- rates:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
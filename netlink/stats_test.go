@@ -0,0 +1,65 @@
+package netlink
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRatesBetween(t *testing.T) {
+	start := time.Unix(1000, 0)
+	prev := &InterfaceStats{
+		Iface: "tap0",
+		Time:  start,
+		RX:    Counters{Bytes: 1000, Packets: 10, Drops: 1},
+		TX:    Counters{Bytes: 5000, Packets: 50},
+	}
+
+	tests := []struct {
+		name   string
+		cur    InterfaceStats
+		wantRX RateCounters
+		wantTX RateCounters
+	}{
+		{
+			name: "growing counters",
+			cur: InterfaceStats{
+				Time: start.Add(2 * time.Second),
+				RX:   Counters{Bytes: 3000, Packets: 30, Drops: 5},
+				TX:   Counters{Bytes: 6000, Packets: 60},
+			},
+			wantRX: RateCounters{BytesPerSec: 1000, PacketsPerSec: 10, DropsPerSec: 2},
+			wantTX: RateCounters{BytesPerSec: 500, PacketsPerSec: 5},
+		},
+		{
+			name: "recreated interface",
+			cur: InterfaceStats{
+				Time: start.Add(time.Second),
+				RX:   Counters{Bytes: 10, Packets: 1},
+				TX:   Counters{Bytes: 7000, Packets: 40},
+			},
+			wantTX: RateCounters{BytesPerSec: 2000},
+		},
+		{
+			name: "no interval",
+			cur: InterfaceStats{
+				Time: start,
+				RX:   Counters{Bytes: 3000},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cur.Iface = "tap0"
+			got := RatesBetween(prev, &tt.cur)
+			if got.Iface != "tap0" || got.Interval != tt.cur.Time.Sub(start) {
+				t.Errorf("RatesBetween() = %s over %s", got.Iface, got.Interval)
+			}
+			if got.RX != tt.wantRX {
+				t.Errorf("RX = %+v, want %+v", got.RX, tt.wantRX)
+			}
+			if got.TX != tt.wantTX {
+				t.Errorf("TX = %+v, want %+v", got.TX, tt.wantTX)
+			}
+		})
+	}
+}
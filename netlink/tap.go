@@ -2,11 +2,12 @@ package netlink
 
 import (
 	"fmt"
-	"os/exec"
-	"strconv"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/privilege"
 )
 
 func (ops defaultNetlinkOps) AttachTap(nsPath string, tapName string, mtu int, ownerUID int, ownerGID int) error {
@@ -16,7 +17,7 @@ func (ops defaultNetlinkOps) AttachTap(nsPath string, tapName string, mtu int, o
 	}
 	defer nsorigin.Close()
 
-	nsHandle, err := netns.GetFromPath(nsPath)
+	nsHandle, err := getNS(nsPath)
 	if err != nil {
 		return err
 	}
@@ -24,7 +25,7 @@ func (ops defaultNetlinkOps) AttachTap(nsPath string, tapName string, mtu int, o
 
 	bool := nsorigin.Equal(nsHandle)
 	if bool {
-		return fmt.Errorf("process is not in the host namespace")
+		return fmt.Errorf("%w: %s", ErrHostNamespace, nsPath)
 	}
 	if err := WithNetNS(nsHandle, func() error {
 		_, err := createTap(tapName, mtu, ownerUID, ownerGID)
@@ -38,77 +39,40 @@ func (ops defaultNetlinkOps) AttachTap(nsPath string, tapName string, mtu int, o
 	return nil
 }
 
-// func (ops defaultNetlinkOps) CreateTap(name string, mtu int, ownerUID int, ownerGID int) (netlink.Link, error) {
-// 	tapLinkAttrs := netlink.NewLinkAttrs()
-// 	tapLinkAttrs.Name = name
-// 	taplink := &netlink.Tuntap{
-// 		LinkAttrs: tapLinkAttrs,
-// 		Mode:      netlink.TUNTAP_MODE_TAP,
-// 		// Queues:    1,
-// 		// Flags:     netlink.TUNTAP_ONE_QUEUE | netlink.TUNTAP_VNET_HDR,
-// 	}
-// 	err := netlink.LinkAdd(taplink)
-// 	if err != nil {
-// 		return nil, fmt.Errorf("failed to create tap device: %w", err)
-// 	}
-// 	cleanup := func(format string, a ...interface{}) (*netlink.Tuntap, error) {
-// 		netlink.LinkDel(taplink)
-// 		logs.Logger.Errorf(format, a...)
-// 		return nil, fmt.Errorf(format, a...)
-// 	}
-// 	time.Sleep(1 * time.Millisecond)
-// 	for _, tapFd := range taplink.Fds {
-// 		err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETOWNER, ownerUID)
-// 		if err != nil {
-// 			return nil, fmt.Errorf("failed to set tap %s owner to uid %d: %w",
-// 				name, ownerUID, err)
-
-// 		}
-// 		err = unix.IoctlSetInt(int(tapFd.Fd()), unix.TUNSETGROUP, ownerGID)
-// 		if err != nil {
-// 			return nil, fmt.Errorf("failed to set tap %s group to gid %d: %w",
-// 				name, ownerGID, err)
-// 		}
-// 	}
-// 	err = netlink.LinkSetMTU(taplink, mtu)
-// 	if err != nil {
-// 		return nil, fmt.Errorf("failed to set tap device MTU to %d: %w", mtu, err)
-// 	}
-// 	err = netlink.LinkSetUp(taplink)
-// 	if err != nil {
-// 		return cleanup("failed to set tap up: %w", err)
-// 	}
-// 	return taplink, nil
-// }
-
+// createTap creates a persistent tap device the jailed VMM, running as
+// ownerUID and ownerGID, can attach to without further privileges.
 func createTap(name string, mtu int, ownerUID int, ownerGID int) (netlink.Link, error) {
-	cmd := exec.Command("sudo", "ip", "tuntap", "add", "dev", name, "mode", "tap")
-	err := cmd.Run()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create tap device: %w", err)
+	if err := privilege.Require("creating tap devices", privilege.CapNetAdmin); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPermission, err)
 	}
-
-	cmd = exec.Command("sudo", "ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
-	err = cmd.Run()
-	if err != nil {
-		return nil, fmt.Errorf("failed to set tap device MTU to %d: %w", mtu, err)
+	// the tuntap ioctls only report an errno string, find out about an
+	// existing tap first
+	if _, err := netlink.LinkByName(name); err == nil {
+		return nil, linkError(unix.EEXIST, name)
 	}
-
-	cmd = exec.Command("sudo", "chown", fmt.Sprintf("%d:%d", ownerUID, ownerGID), "/dev/net/tun")
-	err = cmd.Run()
-	if err != nil {
-		return nil, fmt.Errorf("failed to set tap %s owner to uid %d and gid %d: %w", name, ownerUID, ownerGID, err)
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	tap := &netlink.Tuntap{
+		LinkAttrs: attrs,
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Owner:     uint32(ownerUID),
+		Group:     uint32(ownerGID),
 	}
-
-	cmd = exec.Command("sudo", "ip", "link", "set", "dev", name, "up")
-	err = cmd.Run()
-	if err != nil {
-		return nil, fmt.Errorf("failed to bring tap device up: %w", err)
+	if err := netlink.LinkAdd(tap); err != nil {
+		return nil, fmt.Errorf("failed to create tap device %s: %w", name, err)
 	}
 
 	link, err := netlink.LinkByName(name)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get link by name: %w", err)
+		return nil, fmt.Errorf("failed to get link by name: %w", linkError(err, name))
+	}
+	if err := netlink.LinkSetMTU(link, mtu); err != nil {
+		netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to set tap device MTU to %d: %w", mtu, permissionError(err))
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		netlink.LinkDel(link)
+		return nil, fmt.Errorf("failed to bring tap device up: %w", permissionError(err))
 	}
 	return link, nil
 }
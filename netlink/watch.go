@@ -0,0 +1,193 @@
+package netlink
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/privilege"
+)
+
+type EventType string
+
+const (
+	LinkAdded   EventType = "link-added"
+	LinkRemoved EventType = "link-removed"
+	// LinkUp and LinkDown follow the operational state: a tap without a
+	// VMM attached or a veth whose peer went away is down even if it is
+	// administratively up.
+	LinkUp      EventType = "link-up"
+	LinkDown    EventType = "link-down"
+	AddrAdded   EventType = "addr-added"
+	AddrRemoved EventType = "addr-removed"
+)
+
+// Event is a change of an interface inside a sandbox namespace.
+type Event struct {
+	Type  EventType
+	Iface string
+	Index int
+	// Addr is set for AddrAdded and AddrRemoved.
+	Addr *net.IPNet
+	Time time.Time
+}
+
+func (e Event) String() string {
+	if e.Addr != nil {
+		return fmt.Sprintf("%s %s %s", e.Type, e.Iface, e.Addr)
+	}
+	return fmt.Sprintf("%s %s", e.Type, e.Iface)
+}
+
+// Watch reports link and address changes inside the namespace at nsPath
+// until ctx is done, restricted to ifaces if any are given. The channel is
+// closed when the watch ends, also when the namespace goes away.
+func Watch(ctx context.Context, nsPath string, ifaces ...string) (<-chan Event, error) {
+	ns, err := getNS(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	done := make(chan struct{})
+	onError := func(err error) {
+		logs.Logger.Errorf("Watching %s failed: %v", nsPath, err)
+	}
+	linkCh := make(chan netlink.LinkUpdate, 64)
+	addrCh := make(chan netlink.AddrUpdate, 64)
+	// subscribing switches a thread into the namespace to open the sockets,
+	// which needs the network capabilities raised on that thread
+	if err := privilege.Do(privilege.Network, func() error {
+		if err := netlink.LinkSubscribeWithOptions(linkCh, done, netlink.LinkSubscribeOptions{
+			Namespace:     &ns,
+			ErrorCallback: onError,
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to links in %s: %w", nsPath, permissionError(err))
+		}
+		if err := netlink.AddrSubscribeWithOptions(addrCh, done, netlink.AddrSubscribeOptions{
+			Namespace:     &ns,
+			ErrorCallback: onError,
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to addresses in %s: %w", nsPath, permissionError(err))
+		}
+		return nil
+	}); err != nil {
+		close(done)
+		return nil, permissionError(err)
+	}
+
+	// links are listed after subscribing so no change falls in between
+	w := &watcher{names: map[int]string{}, up: map[int]bool{}, filter: map[string]bool{}}
+	for _, iface := range ifaces {
+		w.filter[iface] = true
+	}
+	if err := WithNetNS(ns, func() error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			w.names[link.Attrs().Index] = link.Attrs().Name
+			w.up[link.Attrs().Index] = isUp(link.Attrs().RawFlags)
+		}
+		return nil
+	}); err != nil {
+		close(done)
+		return nil, fmt.Errorf("failed to list links in %s: %w", nsPath, err)
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer close(done)
+		for {
+			var evs []Event
+			select {
+			case <-ctx.Done():
+				return
+			case update, ok := <-linkCh:
+				if !ok {
+					return
+				}
+				evs = w.link(update)
+			case update, ok := <-addrCh:
+				if !ok {
+					return
+				}
+				evs = w.addr(update)
+			}
+			for _, ev := range evs {
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// watcher tracks the links of the namespace to turn updates into changes.
+type watcher struct {
+	names  map[int]string
+	up     map[int]bool
+	filter map[string]bool
+}
+
+func (w *watcher) link(update netlink.LinkUpdate) []Event {
+	attrs := update.Attrs()
+	index, name := attrs.Index, attrs.Name
+	now := time.Now()
+	var evs []Event
+	switch update.Header.Type {
+	case unix.RTM_DELLINK:
+		// the name is kept for the address removals that follow
+		delete(w.up, index)
+		evs = append(evs, Event{Type: LinkRemoved, Iface: name, Index: index, Time: now})
+	case unix.RTM_NEWLINK:
+		wasUp, known := w.up[index]
+		w.names[index] = name
+		w.up[index] = isUp(attrs.RawFlags)
+		if !known {
+			evs = append(evs, Event{Type: LinkAdded, Iface: name, Index: index, Time: now})
+		}
+		if w.up[index] && (!known || !wasUp) {
+			evs = append(evs, Event{Type: LinkUp, Iface: name, Index: index, Time: now})
+		}
+		if !w.up[index] && known && wasUp {
+			evs = append(evs, Event{Type: LinkDown, Iface: name, Index: index, Time: now})
+		}
+	}
+	if len(w.filter) > 0 && !w.filter[name] {
+		return nil
+	}
+	return evs
+}
+
+func (w *watcher) addr(update netlink.AddrUpdate) []Event {
+	name := w.names[update.LinkIndex]
+	if name == "" {
+		name = fmt.Sprintf("if%d", update.LinkIndex)
+	}
+	if len(w.filter) > 0 && !w.filter[name] {
+		return nil
+	}
+	addr := update.LinkAddress
+	ev := Event{Type: AddrRemoved, Iface: name, Index: update.LinkIndex, Addr: &addr, Time: time.Now()}
+	if update.NewAddr {
+		ev.Type = AddrAdded
+	}
+	return []Event{ev}
+}
+
+// isUp is true for an administratively up interface that is also
+// operationally up, which is what IFF_RUNNING reports.
+func isUp(rawFlags uint32) bool {
+	return rawFlags&unix.IFF_UP != 0 && rawFlags&unix.IFF_RUNNING != 0
+}
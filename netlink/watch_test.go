@@ -0,0 +1,104 @@
+package netlink
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+func linkUpdate(msgType uint16, index int, name string, flags uint32) netlink.LinkUpdate {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Index = index
+	attrs.Name = name
+	attrs.RawFlags = flags
+	return netlink.LinkUpdate{
+		IfInfomsg: nl.IfInfomsg{IfInfomsg: unix.IfInfomsg{Index: int32(index)}},
+		Header:    unix.NlMsghdr{Type: msgType},
+		Link:      &netlink.Dummy{LinkAttrs: attrs},
+	}
+}
+
+func types(evs []Event) []EventType {
+	var got []EventType
+	for _, ev := range evs {
+		got = append(got, ev.Type)
+	}
+	return got
+}
+
+func TestWatcherLink(t *testing.T) {
+	const up = unix.IFF_UP | unix.IFF_RUNNING
+	w := &watcher{names: map[int]string{}, up: map[int]bool{}, filter: map[string]bool{}}
+	steps := []struct {
+		name   string
+		update netlink.LinkUpdate
+		want   []EventType
+	}{
+		{"new link down", linkUpdate(unix.RTM_NEWLINK, 2, "tap0", unix.IFF_UP), []EventType{LinkAdded}},
+		{"no change", linkUpdate(unix.RTM_NEWLINK, 2, "tap0", unix.IFF_UP), nil},
+		{"carrier", linkUpdate(unix.RTM_NEWLINK, 2, "tap0", up), []EventType{LinkUp}},
+		{"carrier lost", linkUpdate(unix.RTM_NEWLINK, 2, "tap0", unix.IFF_UP), []EventType{LinkDown}},
+		{"new link up", linkUpdate(unix.RTM_NEWLINK, 3, "eth0", up), []EventType{LinkAdded, LinkUp}},
+		{"removed", linkUpdate(unix.RTM_DELLINK, 2, "tap0", 0), []EventType{LinkRemoved}},
+		{"re-added", linkUpdate(unix.RTM_NEWLINK, 2, "tap0", 0), []EventType{LinkAdded}},
+	}
+	for _, step := range steps {
+		if got := types(w.link(step.update)); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: link() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestWatcherAddr(t *testing.T) {
+	w := &watcher{names: map[int]string{2: "tap0", 3: "eth0"}, up: map[int]bool{}, filter: map[string]bool{"tap0": true}}
+	_, addr, _ := net.ParseCIDR("10.0.0.2/30")
+
+	evs := w.addr(netlink.AddrUpdate{LinkAddress: *addr, LinkIndex: 2, NewAddr: true})
+	if len(evs) != 1 || evs[0].Type != AddrAdded || evs[0].Iface != "tap0" || evs[0].Addr.String() != "10.0.0.0/30" {
+		t.Errorf("addr() = %v, want an added address on tap0", evs)
+	}
+	evs = w.addr(netlink.AddrUpdate{LinkAddress: *addr, LinkIndex: 2})
+	if len(evs) != 1 || evs[0].Type != AddrRemoved {
+		t.Errorf("addr() = %v, want a removed address", evs)
+	}
+	if evs := w.addr(netlink.AddrUpdate{LinkAddress: *addr, LinkIndex: 3, NewAddr: true}); len(evs) != 0 {
+		t.Errorf("addr() of a filtered interface = %v", evs)
+	}
+
+	w.filter = map[string]bool{}
+	evs = w.addr(netlink.AddrUpdate{LinkAddress: *addr, LinkIndex: 9, NewAddr: true})
+	if len(evs) != 1 || evs[0].Iface != "if9" {
+		t.Errorf("addr() of an unknown link = %v, want it named if9", evs)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ns := newNS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := Watch(ctx, nsPath(ns), "tap0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WithNetNS(ns, func() error {
+		_, err := createTap("tap0", 1500, 0, 0)
+		return err
+	}); err != nil {
+		t.Skipf("cannot create a tap: %v", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != LinkAdded || ev.Iface != "tap0" {
+			t.Errorf("first event = %v, want %s tap0", ev, LinkAdded)
+		}
+	case <-ctx.Done():
+		t.Fatal("no event for the added link")
+	}
+}
@@ -0,0 +1,220 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/ignite/pkg/logs"
+
+	"ranjankuldeep/test/netlink"
+)
+
+// ErrNotFound is returned when removing a port forward that does not exist.
+var ErrNotFound = errors.New("port forward not found")
+
+// DialTimeout bounds connecting to the guest for every forwarded connection.
+const DialTimeout = 10 * time.Second
+
+// Mapping exposes a guest TCP port on the host.
+type Mapping struct {
+	VMID string
+	// HostAddr is the address to listen on, e.g. "0.0.0.0:2222". Port 0
+	// picks a free port, Add returns the resolved address.
+	HostAddr string
+	// GuestAddr is the guest service, e.g. "172.16.0.2:22".
+	GuestAddr string
+	// NSPath dials the guest from inside that namespace if set, for guests
+	// only reachable there. Leave it empty for tc-redirect sandboxes: the
+	// guest shares the sandbox address, which inside the namespace is the
+	// sandbox itself, while the host reaches the guest over the container
+	// network.
+	NSPath string
+}
+
+// Forwarder proxies host ports to guests in userspace. Mappings are kept per
+// VM so they can be listed and torn down with it.
+type Forwarder struct {
+	mu       sync.Mutex
+	forwards map[string]map[string]*forward
+}
+
+type forward struct {
+	Mapping
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func NewForwarder() *Forwarder {
+	return &Forwarder{forwards: map[string]map[string]*forward{}}
+}
+
+// Add starts listening on the mapping's host address and forwards every
+// accepted connection to the guest.
+func (f *Forwarder) Add(m Mapping) (Mapping, error) {
+	listener, err := net.Listen("tcp", m.HostAddr)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("failed to listen on %s: %w", m.HostAddr, err)
+	}
+	m.HostAddr = listener.Addr().String()
+	fwd := &forward{Mapping: m, listener: listener, conns: map[net.Conn]struct{}{}}
+
+	f.mu.Lock()
+	if f.forwards[m.VMID] == nil {
+		f.forwards[m.VMID] = map[string]*forward{}
+	}
+	f.forwards[m.VMID][m.HostAddr] = fwd
+	f.mu.Unlock()
+
+	fwd.wg.Add(1)
+	go fwd.serve()
+	logs.Logger.Infof("Forwarding %s to %s of VM %s", m.HostAddr, m.GuestAddr, m.VMID)
+	return m, nil
+}
+
+// List returns the mappings of a VM ordered by host address.
+func (f *Forwarder) List(vmID string) []Mapping {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var mappings []Mapping
+	for _, fwd := range f.forwards[vmID] {
+		mappings = append(mappings, fwd.Mapping)
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].HostAddr < mappings[j].HostAddr
+	})
+	return mappings
+}
+
+// Remove stops the mapping of a VM on hostAddr, as returned by Add, and closes
+// its open connections.
+func (f *Forwarder) Remove(vmID string, hostAddr string) error {
+	f.mu.Lock()
+	fwd, ok := f.forwards[vmID][hostAddr]
+	if ok {
+		delete(f.forwards[vmID], hostAddr)
+		if len(f.forwards[vmID]) == 0 {
+			delete(f.forwards, vmID)
+		}
+	}
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: VM %s on %s", ErrNotFound, vmID, hostAddr)
+	}
+	fwd.close()
+	return nil
+}
+
+// RemoveAll stops every mapping of a VM.
+func (f *Forwarder) RemoveAll(vmID string) {
+	f.mu.Lock()
+	forwards := f.forwards[vmID]
+	delete(f.forwards, vmID)
+	f.mu.Unlock()
+	for _, fwd := range forwards {
+		fwd.close()
+	}
+}
+
+func (fwd *forward) serve() {
+	defer fwd.wg.Done()
+	for {
+		conn, err := fwd.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logs.Logger.Errorf("Stopped forwarding %s: %v", fwd.HostAddr, err)
+			}
+			return
+		}
+		fwd.wg.Add(1)
+		go func() {
+			defer fwd.wg.Done()
+			fwd.proxy(conn)
+		}()
+	}
+}
+
+func (fwd *forward) proxy(client net.Conn) {
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), DialTimeout)
+	defer cancel()
+	guest, err := fwd.dial(ctx)
+	if err != nil {
+		logs.Logger.Errorf("Failed to reach %s of VM %s: %v", fwd.GuestAddr, fwd.VMID, err)
+		return
+	}
+	defer guest.Close()
+	if !fwd.track(client, guest) {
+		return
+	}
+	defer fwd.untrack(client, guest)
+
+	done := make(chan struct{})
+	go func() {
+		pipe(guest, client)
+		close(done)
+	}()
+	pipe(client, guest)
+	<-done
+}
+
+func (fwd *forward) dial(ctx context.Context) (net.Conn, error) {
+	if fwd.NSPath == "" {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", fwd.GuestAddr)
+	}
+	return netlink.DialContextInNS(ctx, fwd.NSPath, "tcp", fwd.GuestAddr)
+}
+
+// pipe copies src to dst and then half-closes dst, so each direction ends on
+// its own.
+func pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+		return
+	}
+	dst.Close()
+}
+
+// track registers the connections for close, it returns false if the forward
+// is already closing.
+func (fwd *forward) track(conns ...net.Conn) bool {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	if fwd.conns == nil {
+		return false
+	}
+	for _, c := range conns {
+		fwd.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (fwd *forward) untrack(conns ...net.Conn) {
+	fwd.mu.Lock()
+	defer fwd.mu.Unlock()
+	for _, c := range conns {
+		delete(fwd.conns, c)
+	}
+}
+
+func (fwd *forward) close() {
+	fwd.listener.Close()
+	fwd.mu.Lock()
+	for c := range fwd.conns {
+		c.Close()
+	}
+	fwd.conns = nil
+	fwd.mu.Unlock()
+	fwd.wg.Wait()
+	logs.Logger.Infof("Stopped forwarding %s to %s of VM %s", fwd.HostAddr, fwd.GuestAddr, fwd.VMID)
+}
@@ -0,0 +1,134 @@
+package portforward
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoServer stands in for the guest service.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Errorf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	guest := echoServer(t)
+	f := NewForwarder()
+
+	var mappings []Mapping
+	for i := 0; i < 2; i++ {
+		m, err := f.Add(Mapping{VMID: "vm-1", HostAddr: "127.0.0.1:0", GuestAddr: guest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.HostAddr == "127.0.0.1:0" {
+			t.Fatal("Add() did not resolve the host port")
+		}
+		mappings = append(mappings, m)
+	}
+	if list := f.List("vm-1"); len(list) != 2 || list[0].HostAddr > list[1].HostAddr {
+		t.Errorf("List() = %v, want both mappings ordered by host address", list)
+	}
+	if list := f.List("vm-2"); len(list) != 0 {
+		t.Errorf("List() of another VM = %v", list)
+	}
+
+	conn, err := net.Dial("tcp", mappings[0].HostAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "hello")
+
+	// removing the mapping closes its open connections
+	if err := f.Remove("vm-1", mappings[0].HostAddr); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open after Remove")
+	}
+	if _, err := net.Dial("tcp", mappings[0].HostAddr); err == nil {
+		t.Error("host port still listening after Remove")
+	}
+	if err := f.Remove("vm-1", mappings[0].HostAddr); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Remove() again = %v, want %v", err, ErrNotFound)
+	}
+
+	conn, err = net.Dial("tcp", mappings[1].HostAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "world")
+
+	f.RemoveAll("vm-1")
+	if list := f.List("vm-1"); len(list) != 0 {
+		t.Errorf("List() after RemoveAll = %v", list)
+	}
+	if _, err := net.Dial("tcp", mappings[1].HostAddr); err == nil {
+		t.Error("host port still listening after RemoveAll")
+	}
+}
+
+func TestForwarderUnreachableGuest(t *testing.T) {
+	// a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest := listener.Addr().String()
+	listener.Close()
+
+	f := NewForwarder()
+	m, err := f.Add(Mapping{VMID: "vm-1", HostAddr: "127.0.0.1:0", GuestAddr: guest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.RemoveAll("vm-1")
+
+	conn, err := net.Dial("tcp", m.HostAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("client connection stays open while the guest is unreachable")
+	}
+}
@@ -0,0 +1,290 @@
+// Package preflight checks that a host can run jailed Firecracker VMs, so a
+// launch fails up front with every problem listed instead of deep inside
+// Firecracker.
+package preflight
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/weaveworks/ignite/pkg/logs"
+	"golang.org/x/sys/unix"
+
+	"ranjankuldeep/test/helper"
+	"ranjankuldeep/test/privilege"
+)
+
+// MinFirecrackerVersion is the oldest Firecracker the SDK works with.
+const MinFirecrackerVersion = "1.0.0"
+
+// KVMAPIVersion is the only KVM API version there is.
+const KVMAPIVersion = 12
+
+const kvmGetAPIVersion = 0xae00
+
+// Config names what a launch needs from the host. Empty fields are not
+// checked.
+type Config struct {
+	JailerBinary      string
+	FirecrackerBinary string
+	KernelImage       string
+	// Drives must be readable, and writable unless listed in ReadOnly.
+	Drives   []string
+	ReadOnly []string
+	// Snapshots requires device mapper and loop devices, for root drives
+	// created from a base image.
+	Snapshots bool
+	// CgroupControllers must be available in the cgroup v2 hierarchy.
+	CgroupControllers []string
+	CgroupRoot        string
+	// Privileges are the operations the process has to hold the
+	// capabilities for.
+	Privileges []privilege.Requirement
+	// Helper requires the privileged helper to hold its capabilities, unless
+	// the process is root.
+	Helper bool
+}
+
+// Failure is a check that did not pass.
+type Failure struct {
+	Check string
+	Err   error
+}
+
+// Error lists every failed check.
+type Error struct {
+	Failures []Failure
+}
+
+func (e *Error) Error() string {
+	lines := []string{fmt.Sprintf("host is not ready, %d checks failed:", len(e.Failures))}
+	for _, f := range e.Failures {
+		lines = append(lines, fmt.Sprintf("  %s: %v", f.Check, f.Err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *Error) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// Run runs every check that applies to cfg and returns an *Error listing all
+// failures.
+func Run(cfg Config) error {
+	var failures []Failure
+	check := func(name string, err error) {
+		if err != nil {
+			failures = append(failures, Failure{Check: name, Err: err})
+			return
+		}
+		logs.Logger.Debugf("Preflight check %s passed", name)
+	}
+
+	if len(cfg.Privileges) > 0 {
+		check("privileges", privilege.Check(cfg.Privileges...))
+	}
+	if cfg.Helper {
+		check("helper", helper.Check())
+	}
+	check("kvm", CheckKVM())
+	if cfg.JailerBinary != "" || cfg.FirecrackerBinary != "" {
+		check("binaries", CheckBinaries(cfg.JailerBinary, cfg.FirecrackerBinary))
+	}
+	if cfg.KernelImage != "" {
+		check("kernel", checkReadable(cfg.KernelImage))
+	}
+	readOnly := map[string]bool{}
+	for _, path := range cfg.ReadOnly {
+		readOnly[path] = true
+	}
+	for _, path := range cfg.Drives {
+		if readOnly[path] {
+			check("drive "+path, checkReadable(path))
+		} else {
+			check("drive "+path, checkWritable(path))
+		}
+	}
+	root := cfg.CgroupRoot
+	if root == "" {
+		root = "/sys/fs/cgroup"
+	}
+	check("cgroup v2", CheckCgroupV2(root, cfg.CgroupControllers...))
+	if cfg.Snapshots {
+		check("device mapper", CheckDeviceMapper())
+		check("loop devices", CheckLoop())
+	}
+
+	if len(failures) > 0 {
+		return &Error{Failures: failures}
+	}
+	return nil
+}
+
+// CheckKVM checks that /dev/kvm can be opened for reading and writing and
+// speaks the expected API. A process that may not open it only checks that
+// it exists, the jailer gives the VMM a node of its own.
+func CheckKVM() error {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if errors.Is(err, os.ErrPermission) {
+		return checkCharDevice("/dev/kvm")
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	version, err := unix.IoctlRetInt(int(f.Fd()), kvmGetAPIVersion)
+	if err != nil {
+		return fmt.Errorf("failed to get KVM API version: %w", err)
+	}
+	if version != KVMAPIVersion {
+		return fmt.Errorf("unsupported KVM API version %d", version)
+	}
+	return nil
+}
+
+// checkCharDevice checks that path is a character device.
+func checkCharDevice(path string) error {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFCHR {
+		return fmt.Errorf("%s is not a character device", path)
+	}
+	return nil
+}
+
+var versionPattern = regexp.MustCompile(`v(\d+)\.(\d+)\.(\d+)`)
+
+// Version runs binary with --version and returns the version it reports,
+// e.g. "1.7.0".
+func Version(binary string) (string, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return "", err
+	}
+	out, err := exec.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s --version failed: %w", path, err)
+	}
+	match := versionPattern.FindStringSubmatch(string(out))
+	if match == nil {
+		return "", fmt.Errorf("%s reported no version: %q", path, strings.TrimSpace(string(out)))
+	}
+	return strings.Join(match[1:], "."), nil
+}
+
+// CheckBinaries checks that the jailer and Firecracker binaries run, are
+// recent enough and come from the same release.
+func CheckBinaries(jailer, firecracker string) error {
+	var errs []error
+	versions := map[string]string{}
+	for _, binary := range []string{jailer, firecracker} {
+		if binary == "" {
+			continue
+		}
+		version, err := Version(binary)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if compareVersions(version, MinFirecrackerVersion) < 0 {
+			errs = append(errs, fmt.Errorf("%s is version %s, %s or newer is required", binary, version, MinFirecrackerVersion))
+		}
+		versions[binary] = version
+	}
+	if v1, v2 := versions[jailer], versions[firecracker]; v1 != "" && v2 != "" && v1 != v2 {
+		errs = append(errs, fmt.Errorf("jailer %s and firecracker %s are from different releases", v1, v2))
+	}
+	return errors.Join(errs...)
+}
+
+// compareVersions compares two "major.minor.patch" versions.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.Atoi(as[i])
+		y, _ := strconv.Atoi(bs[i])
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
+
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// CheckCgroupV2 checks that root is a cgroup v2 hierarchy offering the
+// controllers.
+func CheckCgroupV2(root string, controllers ...string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(root, &st); err != nil {
+		return &os.PathError{Op: "statfs", Path: root, Err: err}
+	}
+	if st.Type != unix.CGROUP2_SUPER_MAGIC {
+		return fmt.Errorf("%s is not a cgroup v2 hierarchy", root)
+	}
+	data, err := os.ReadFile(root + "/cgroup.controllers")
+	if err != nil {
+		return err
+	}
+	available := map[string]bool{}
+	for _, c := range strings.Fields(string(data)) {
+		available[c] = true
+	}
+	var missing []string
+	for _, c := range controllers {
+		if !available[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("cgroup controllers %s are not available", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckDeviceMapper checks that the kernel has device mapper and dmsetup is
+// installed. The snapshot target is loaded on first use. Only root can open
+// the control device, so it is only checked to exist.
+func CheckDeviceMapper() error {
+	if err := checkCharDevice("/dev/mapper/control"); err != nil {
+		return fmt.Errorf("device mapper is not available, is dm_mod loaded? %w", err)
+	}
+	_, err := exec.LookPath("dmsetup")
+	return err
+}
+
+// CheckLoop checks that the kernel can allocate loop devices.
+func CheckLoop() error {
+	if err := checkCharDevice("/dev/loop-control"); err != nil {
+		return fmt.Errorf("loop devices are not available, is the loop module loaded? %w", err)
+	}
+	return nil
+}
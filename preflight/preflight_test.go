@@ -0,0 +1,99 @@
+package preflight
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.7.0", "1.7.0", 0},
+		{"1.7.1", "1.7.0", 1},
+		{"1.6.9", "1.7.0", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.7", "1.7.0", -1},
+	}
+	for _, tt := range tests {
+		got := compareVersions(tt.a, tt.b)
+		if sign(got) != tt.want {
+			t.Errorf("compareVersions(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// fakeBinary writes a script that reports output for --version.
+func fakeBinary(t *testing.T, name, output string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	script := "#!/bin/sh\necho '" + output + "'\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{output: "Firecracker v1.7.0", want: "1.7.0"},
+		{output: "Jailer v1.10.1-dev\n\nExiting successfully", want: "1.10.1"},
+		{output: "unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := Version(fakeBinary(t, "firecracker", tt.output))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Version() for %q error = %v, wantErr %v", tt.output, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Version() for %q = %s, want %s", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBinaries(t *testing.T) {
+	tests := []struct {
+		name                string
+		jailer, firecracker string
+		wantErr             bool
+	}{
+		{"same release", "Jailer v1.7.0", "Firecracker v1.7.0", false},
+		{"different releases", "Jailer v1.8.0", "Firecracker v1.7.0", true},
+		{"too old", "Jailer v0.25.0", "Firecracker v0.25.0", true},
+	}
+	for _, tt := range tests {
+		err := CheckBinaries(fakeBinary(t, "jailer", tt.jailer), fakeBinary(t, "firecracker", tt.firecracker))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: CheckBinaries() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckCharDevice(t *testing.T) {
+	if err := checkCharDevice(os.DevNull); err != nil {
+		t.Errorf("checkCharDevice(%s) = %v", os.DevNull, err)
+	}
+	for _, path := range []string{t.TempDir(), filepath.Join(t.TempDir(), "missing")} {
+		if err := checkCharDevice(path); err == nil {
+			t.Errorf("checkCharDevice(%s) succeeded", path)
+		}
+	}
+}
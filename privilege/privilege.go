@@ -0,0 +1,250 @@
+// Package privilege describes which capabilities each part of a launch needs,
+// so the controller can run as an unprivileged user instead of as root.
+//
+// The controller only holds CAP_NET_ADMIN and CAP_SYS_ADMIN, for the sandbox
+// network, and only in its permitted set, e.g. granted with setcap +p on its
+// binary. They are raised into the effective set of the one thread doing the
+// namespace, tap, nftables and tc work and dropped again afterwards, see Do.
+// The root drive snapshots, the chroot and the jailer are left to the
+// firetest-helper binary, which holds the capabilities of Helper, see
+// package helper. Everything else, address and identity allocation, port forwarding, runs
+// without privileges.
+package privilege
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Capability is a Linux capability number.
+type Capability uintptr
+
+const (
+	CapChown          Capability = unix.CAP_CHOWN
+	CapDACOverride    Capability = unix.CAP_DAC_OVERRIDE
+	CapFowner         Capability = unix.CAP_FOWNER
+	CapSetGID         Capability = unix.CAP_SETGID
+	CapSetUID         Capability = unix.CAP_SETUID
+	CapNetAdmin       Capability = unix.CAP_NET_ADMIN
+	CapNetRaw         Capability = unix.CAP_NET_RAW
+	CapSysChroot      Capability = unix.CAP_SYS_CHROOT
+	CapSysAdmin       Capability = unix.CAP_SYS_ADMIN
+	CapMknod          Capability = unix.CAP_MKNOD
+	CapNetBindService Capability = unix.CAP_NET_BIND_SERVICE
+	CapKill           Capability = unix.CAP_KILL
+)
+
+var names = map[Capability]string{
+	CapChown:          "CAP_CHOWN",
+	CapDACOverride:    "CAP_DAC_OVERRIDE",
+	CapFowner:         "CAP_FOWNER",
+	CapSetGID:         "CAP_SETGID",
+	CapSetUID:         "CAP_SETUID",
+	CapNetAdmin:       "CAP_NET_ADMIN",
+	CapNetRaw:         "CAP_NET_RAW",
+	CapSysChroot:      "CAP_SYS_CHROOT",
+	CapSysAdmin:       "CAP_SYS_ADMIN",
+	CapMknod:          "CAP_MKNOD",
+	CapNetBindService: "CAP_NET_BIND_SERVICE",
+	CapKill:           "CAP_KILL",
+}
+
+func (c Capability) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("capability %d", uintptr(c))
+}
+
+// Requirement is the set of capabilities an operation needs.
+type Requirement struct {
+	Operation string
+	Caps      []Capability
+}
+
+var (
+	// Network covers entering the sandbox namespace and the taps, tc filters,
+	// nftables rules and sysctls of the sandbox network.
+	Network = Requirement{
+		Operation: "setting up the sandbox network",
+		Caps:      []Capability{CapNetAdmin, CapSysAdmin},
+	}
+	// Helper is what the firetest-helper binary holds in its permitted set,
+	// it raises a part of it for each of its operations.
+	Helper = Requirement{
+		Operation: "running the privileged helper",
+		Caps: []Capability{CapSysAdmin, CapDACOverride, CapFowner, CapChown, CapMknod,
+			CapSetUID, CapKill, CapNetRaw},
+	}
+)
+
+// Missing lists the capabilities an operation lacks.
+type Missing struct {
+	Operation string
+	Caps      []Capability
+}
+
+// MissingError reports every operation the process lacks capabilities for.
+type MissingError struct {
+	Missing []Missing
+}
+
+func (e *MissingError) Error() string {
+	var parts []string
+	for _, m := range e.Missing {
+		caps := make([]string, len(m.Caps))
+		for i, c := range m.Caps {
+			caps[i] = c.String()
+		}
+		parts = append(parts, fmt.Sprintf("%s requires %s", m.Operation, strings.Join(caps, ", ")))
+	}
+	return "missing capabilities: " + strings.Join(parts, "; ")
+}
+
+// Is makes a MissingError match the EPERM the operations would fail with.
+func (e *MissingError) Is(target error) bool {
+	return target == unix.EPERM
+}
+
+// sets returns the capability sets of the calling thread.
+func sets() (unix.CapUserHeader, [2]unix.CapUserData, error) {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return header, data, fmt.Errorf("failed to get capabilities: %w", err)
+	}
+	return header, data, nil
+}
+
+// Effective returns the effective capability set of the calling thread.
+func Effective() (uint64, error) {
+	_, data, err := sets()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(data[0].Effective) | uint64(data[1].Effective)<<32, nil
+}
+
+// Permitted returns the capabilities the calling thread can raise.
+func Permitted() (uint64, error) {
+	_, data, err := sets()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(data[0].Permitted) | uint64(data[1].Permitted)<<32, nil
+}
+
+// Check returns a *MissingError naming the capabilities the process cannot
+// raise for any of the requirements.
+func Check(reqs ...Requirement) error {
+	permitted, err := Permitted()
+	if err != nil {
+		return err
+	}
+	return missing(permitted, reqs)
+}
+
+// Require checks that caps are raised on the calling thread for operation.
+func Require(operation string, caps ...Capability) error {
+	effective, err := Effective()
+	if err != nil {
+		return err
+	}
+	return missing(effective, []Requirement{{Operation: operation, Caps: caps}})
+}
+
+func missing(set uint64, reqs []Requirement) error {
+	var missing []Missing
+	for _, req := range reqs {
+		var caps []Capability
+		for _, c := range req.Caps {
+			if set&(1<<uint(c)) == 0 {
+				caps = append(caps, c)
+			}
+		}
+		if len(caps) > 0 {
+			missing = append(missing, Missing{Operation: req.Operation, Caps: caps})
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingError{Missing: missing}
+	}
+	return nil
+}
+
+// Raise adds the capabilities of req to the effective set of the calling
+// thread, which must be locked to its goroutine, and returns the function
+// restoring the set it had before. Capabilities are per thread, the other
+// threads of the process are not affected.
+func Raise(req Requirement) (restore func() error, err error) {
+	header, old, err := sets()
+	if err != nil {
+		return nil, err
+	}
+	permitted := uint64(old[0].Permitted) | uint64(old[1].Permitted)<<32
+	if err := missing(permitted, []Requirement{req}); err != nil {
+		return nil, err
+	}
+	raised := old
+	for _, c := range req.Caps {
+		raised[c/32].Effective |= 1 << (uint(c) % 32)
+	}
+	if err := unix.Capset(&header, &raised[0]); err != nil {
+		return nil, fmt.Errorf("failed to raise capabilities for %s: %w", req.Operation, err)
+	}
+	return func() error {
+		if err := unix.Capset(&header, &old[0]); err != nil {
+			return fmt.Errorf("failed to drop capabilities raised for %s: %w", req.Operation, err)
+		}
+		return nil
+	}, nil
+}
+
+// Do runs fn with the capabilities of req raised. fn runs on a dedicated
+// goroutine locked to its OS thread, like netlink.WithNetNS, and must not
+// start goroutines relying on the capabilities. If the capabilities cannot be
+// dropped again the thread is left locked when the goroutine exits, which
+// makes the Go runtime terminate it.
+func Do(req Requirement, fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		restore, err := Raise(req)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		fnErr := fn()
+		if err := restore(); err != nil {
+			errCh <- errors.Join(fnErr, err)
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- fnErr
+	}()
+	return <-errCh
+}
+
+// Inherit passes caps on to cmd as ambient capabilities, which an
+// unprivileged process otherwise loses when it executes a binary. The caps
+// must be permitted, they need not be raised. Root keeps its capabilities
+// across exec and needs none.
+func Inherit(cmd *exec.Cmd, caps ...Capability) {
+	if os.Geteuid() == 0 {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	for _, c := range caps {
+		cmd.SysProcAttr.AmbientCaps = append(cmd.SysProcAttr.AmbientCaps, uintptr(c))
+	}
+}
@@ -1,98 +1,113 @@
 package snapshot
 
 import (
-	"crypto/rand"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
 
-	losetup "github.com/freddierice/go-losetup"
+	"github.com/weaveworks/ignite/pkg/logs"
+
+	"ranjankuldeep/test/helper"
+	"ranjankuldeep/test/vmid"
 )
 
-func CreateDeviceMapper(base string, overlayDir string) (*Device, error) {
-	id := randomString()
+// CreateDeviceMapper creates the VM's copy-on-write snapshot of base, with
+// the writes kept in an overlay file in overlayDir. Whatever it created is
+// removed again if a later step fails.
+func CreateDeviceMapper(id vmid.ID, base string, overlayDir string) (_ *Device, err error) {
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				logs.Logger.Errorf("Failed to clean up the snapshot of VM %s: %v", id, undoErr)
+			}
+		}
+	}()
 
 	// create and truncate the overlay file
 	baseInfo, err := os.Stat(base)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't stat file %s: %v", base, err)
 	}
-	overlayFilename := fmt.Sprintf("%s/image-%s.diff", overlayDir, id)
+	overlayFilename := id.OverlayFile(overlayDir)
 	overlayFile, err := os.Create(overlayFilename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create overlay file %s, %v", overlayFilename, err)
 	}
-	if err := overlayFile.Truncate(baseInfo.Size() + 500000000); err != nil {
+	undo = append(undo, func() error { return os.Remove(overlayFilename) })
+	err = overlayFile.Truncate(baseInfo.Size() + 500000000)
+	overlayFile.Close()
+	if err != nil {
 		return nil, fmt.Errorf("failed to allocate overlay file %s: %v", overlayFilename, err)
 	}
-	defer overlayFile.Close()
 
 	// create the loopback devices
-	baseDev, err := losetup.Attach(base, 0, true)
+	baseDev, err := helper.AttachLoop(base, true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup loop device for %q: %v", base, err)
 	}
-	overlayDev, err := losetup.Attach(overlayFilename, 0, false)
+	undo = append(undo, func() error { return helper.DetachLoop(baseDev) })
+	overlayDev, err := helper.AttachLoop(overlayFilename, false)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup loop device for %q: %v", overlayFilename, err)
 	}
+	undo = append(undo, func() error { return helper.DetachLoop(overlayDev) })
 
 	// get block size of each device for dmsetup
 	baseSize, err := Size512K(baseDev)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get device size for %s: %v", baseDev.Path(), err)
+		return nil, fmt.Errorf("failed to get device size for %s: %v", baseDev, err)
 	}
 	overlaySize, err := Size512K(overlayDev)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get device size for %s: %v", baseDev.Path(), err)
+		return nil, fmt.Errorf("failed to get device size for %s: %v", overlayDev, err)
 	}
 
 	// do the device mapper setup
-	baseName := fmt.Sprintf("base-%s", id)
-	overlayName := fmt.Sprintf("overlay-%s", id)
-	dmBaseTable := []byte(fmt.Sprintf("0 %d linear %s 0\n%d %d zero", baseSize, baseDev.Path(), baseSize, overlaySize))
+	baseName := id.BaseName()
+	overlayName := id.OverlayName()
+	dmBaseTable := []byte(fmt.Sprintf("0 %d linear %s 0\n%d %d zero", baseSize, baseDev, baseSize, overlaySize))
 	if err = DmCreate(baseName, dmBaseTable); err != nil {
-		baseDev.Detach()
-		overlayDev.Detach()
 		return nil, err
 	}
+	undo = append(undo, func() error { return DmRemove(baseName) })
 
 	basePath := fmt.Sprintf("/dev/mapper/%s", baseName)
-	dmTable := []byte(fmt.Sprintf("0 %d snapshot %s %s P 8", overlaySize, basePath, overlayDev.Path()))
+	dmTable := []byte(fmt.Sprintf("0 %d snapshot %s %s P 8", overlaySize, basePath, overlayDev))
 	if err = DmCreate(overlayName, dmTable); err != nil {
-		baseDev.Detach()
-		overlayDev.Detach()
 		return nil, err
 	}
 	return &Device{baseDev, overlayDev, baseName, overlayName, overlayFilename}, nil
 }
 
 type Device struct {
-	BaseDev         losetup.Device
-	OverlayDev      losetup.Device
+	BaseDev         string // /dev/loop$N
+	OverlayDev      string // /dev/loop$N
 	BaseName        string // /dev/mapper/$THIS
 	OverlayName     string // /dev/mapper/$THIS
 	OverlayFilename string
 }
 
+// Cleanup removes the device mapper targets before detaching the loop
+// devices backing them, then deletes the overlay file.
 func (dev *Device) Cleanup() error {
-	err := dev.BaseDev.Detach()
+	err := DmRemove(dev.OverlayName)
 	if err != nil {
 		return err
 	}
-	err = dev.OverlayDev.Detach()
+	err = DmRemove(dev.BaseName)
 	if err != nil {
 		return err
 	}
-	err = DmRemove(dev.OverlayName)
+	err = helper.DetachLoop(dev.OverlayDev)
 	if err != nil {
 		return err
 	}
-	err = DmRemove(dev.BaseName)
+	err = helper.DetachLoop(dev.BaseDev)
 	if err != nil {
 		return err
 	}
@@ -103,19 +118,32 @@ func (dev *Device) Cleanup() error {
 	return nil
 }
 
-func randomString() string {
-	b := make([]byte, 12)
-	_, err := rand.Read(b)
-	if err != nil {
-		log.Fatalf("failed to generate uuid, %s", err)
-	}
+// Loops are the paths of the loop devices backing the device, for
+// RemoveDevice.
+func (dev *Device) Loops() []string {
+	return []string{dev.BaseDev, dev.OverlayDev}
+}
 
-	return fmt.Sprintf("%X", b)
+// RemoveDevice is Cleanup for a device created by another process, found
+// from the VM's ID and the loop devices backing it.
+func RemoveDevice(id vmid.ID, overlayDir string, loops []string) error {
+	if err := DmRemove(id.OverlayName()); err != nil {
+		return err
+	}
+	if err := DmRemove(id.BaseName()); err != nil {
+		return err
+	}
+	for _, loop := range loops {
+		if err := helper.DetachLoop(loop); err != nil {
+			return err
+		}
+	}
+	return os.Remove(id.OverlayFile(overlayDir))
 }
 
 // copied from ignite
-func Size512K(ld losetup.Device) (uint64, error) {
-	data, err := ioutil.ReadFile(path.Join("/sys/class/block", path.Base(ld.Path()), "size"))
+func Size512K(loop string) (uint64, error) {
+	data, err := os.ReadFile(path.Join("/sys/class/block", path.Base(loop), "size"))
 	if err != nil {
 		return 0, err
 	}
@@ -124,41 +152,14 @@ func Size512K(ld losetup.Device) (uint64, error) {
 	return strconv.ParseUint(string(data[:len(data)-1]), 10, 64)
 }
 
-// copied this helper function from ignite, it seems fine
+// DmCreate creates the device mapper target name from table, through the
+// privileged helper.
 func DmCreate(name string, table []byte) error {
-	cmd := exec.Command(
-		"dmsetup", "create",
-		"--verifyudev", // if udevd is not running, dmsetup will manage the device node in /dev/mapper
-		// julia: i have no idea what the above comment means but let's go with it i guess
-		name,
-	)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return err
-	}
-
-	if _, err := stdin.Write(table); err != nil {
-		return err
-	}
-
-	if err := stdin.Close(); err != nil {
-		return err
-	}
-
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("command %q exited with %q: %w", cmd.Args, out, err)
-	}
-
-	return nil
+	return helper.DmCreate(name, table)
 }
 
+// DmRemove removes the device mapper target name, through the privileged
+// helper.
 func DmRemove(name string) error {
-	cmd := exec.Command("dmsetup", "remove", name)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("command %q exited with %q: %w", cmd.Args, out, err)
-	}
-
-	return nil
+	return helper.DmRemove(name)
 }
@@ -0,0 +1,88 @@
+// Package statefile keeps small JSON documents on disk that several
+// processes update, such as the address and identity allocations of VMs.
+package statefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Update loads the JSON document at path into v under an exclusive lock,
+// applies fn and writes v back. A missing or empty file leaves v as passed
+// in, so callers initialise it with the defaults of a fresh state. Nothing
+// is written if fn fails.
+func Update(path string, v interface{}, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory for %s: %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open state %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock state %s: %w", path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read state %s: %w", path, err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("failed to parse state %s: %w", path, err)
+		}
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	data, err = json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to write state %s: %w", path, err)
+	}
+	return f.Sync()
+}
+
+// Read loads the JSON document at path into v under a shared lock, without
+// creating or writing the file. A missing or empty file leaves v as passed
+// in.
+func Read(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open state %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return fmt.Errorf("failed to lock state %s: %w", path, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read state %s: %w", path, err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("failed to parse state %s: %w", path, err)
+		}
+	}
+	return nil
+}
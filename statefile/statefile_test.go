@@ -0,0 +1,111 @@
+package statefile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type doc struct {
+	Count int `json:"count"`
+}
+
+func TestUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "state.json")
+
+	for want := 1; want <= 3; want++ {
+		var d doc
+		if err := Update(path, &d, func() error {
+			d.Count++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if d.Count != want {
+			t.Errorf("count = %d, want %d", d.Count, want)
+		}
+	}
+
+	failed := errors.New("failed")
+	var d doc
+	if err := Update(path, &d, func() error {
+		d.Count = 100
+		return failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("Update() = %v, want %v", err, failed)
+	}
+	var got doc
+	if err := Read(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Count != 3 {
+		t.Errorf("count = %d after a failed update, want 3", got.Count)
+	}
+}
+
+func TestUpdateShrinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	m := map[string]int{"a": 1, "bbbbbbbbbbbbbbbb": 2}
+	if err := Update(path, &m, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	if err := Update(path, &got, func() error {
+		delete(got, "bbbbbbbbbbbbbbbb")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a truncated rewrite leaves no trailing bytes to fail parsing
+	got = map[string]int{}
+	if err := Read(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got["a"] != 1 {
+		t.Errorf("state = %v, want map[a:1]", got)
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		content *string
+		want    int
+		wantErr bool
+	}{
+		{name: "missing", want: 7},
+		{name: "empty", content: ptr(""), want: 7},
+		{name: "document", content: ptr(`{"count": 2}`), want: 2},
+		{name: "corrupt", content: ptr(`{"count":`), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			if tt.content != nil {
+				if err := os.WriteFile(path, []byte(*tt.content), 0444); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := doc{Count: 7}
+			err := Read(path, &d)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Read() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && d.Count != tt.want {
+				t.Errorf("count = %d, want %d", d.Count, tt.want)
+			}
+			if tt.content == nil {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("Read() created %s", path)
+				}
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
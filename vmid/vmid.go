@@ -0,0 +1,92 @@
+// Package vmid is the identity of a VM. Every host resource of a VM is named
+// after its ID, so they can all be found from it.
+package vmid
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// MaxLength is the longest ID the jailer accepts.
+const MaxLength = 64
+
+var ErrInvalid = errors.New("invalid VM ID")
+
+// ID identifies a VM. It is the jailer ID, so it only contains ASCII letters,
+// digits and hyphens.
+type ID string
+
+// New returns a random ID.
+func New() ID {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Errorf("failed to generate VM ID: %w", err))
+	}
+	return ID(hex.EncodeToString(b))
+}
+
+// Parse validates s as an ID.
+func Parse(s string) (ID, error) {
+	id := ID(s)
+	if err := id.Validate(); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Validate checks the ID against the jailer's rules.
+func (id ID) Validate() error {
+	if len(id) == 0 || len(id) > MaxLength {
+		return fmt.Errorf("%w %q: must be 1 to %d characters long", ErrInvalid, string(id), MaxLength)
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return fmt.Errorf("%w %q: only letters, digits and hyphens are allowed", ErrInvalid, string(id))
+		}
+	}
+	return nil
+}
+
+func (id ID) String() string {
+	return string(id)
+}
+
+// TapName is the name of the VM's tap device for the NIC at index. Interface
+// names are limited to 15 characters, so it is derived from a hash of the ID
+// rather than the ID itself.
+func (id ID) TapName(index int) string {
+	sum := sha256.Sum256([]byte(id))
+	return fmt.Sprintf("fc%x-%d", sum[:4], index)
+}
+
+// BaseName is the device mapper target exposing the VM's base image.
+func (id ID) BaseName() string {
+	return "base-" + string(id)
+}
+
+// OverlayName is the device mapper snapshot the VM boots from, found at
+// /dev/mapper/<OverlayName>.
+func (id ID) OverlayName() string {
+	return "overlay-" + string(id)
+}
+
+// OverlayFile is the file in dir backing the VM's snapshot.
+func (id ID) OverlayFile(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("image-%s.diff", id))
+}
+
+// ChrootDir is the directory the jailer creates for the VM when jailing
+// execFile below baseDir.
+func (id ID) ChrootDir(baseDir, execFile string) string {
+	return filepath.Join(baseDir, filepath.Base(execFile), string(id))
+}
+
+// SocketPath is the host path of the VM's API socket named socket, which
+// the jailer places in the chroot's root.
+func (id ID) SocketPath(baseDir, execFile, socket string) string {
+	return filepath.Join(id.ChrootDir(baseDir, execFile), "root", socket)
+}
@@ -0,0 +1,79 @@
+package vmid
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s     string
+		valid bool
+	}{
+		{"vm-1", true},
+		{"ABC123", true},
+		{strings.Repeat("a", MaxLength), true},
+		{"", false},
+		{strings.Repeat("a", MaxLength+1), false},
+		{"vm_1", false},
+		{"vm/1", false},
+		{"../x", false},
+		{"vm 1", false},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.s)
+		if tt.valid && err != nil {
+			t.Errorf("Parse(%q) = %v", tt.s, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalid) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.s, err, ErrInvalid)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	a, b := New(), New()
+	if err := a.Validate(); err != nil {
+		t.Errorf("New() = %q: %v", a, err)
+	}
+	if a == b {
+		t.Errorf("New() returned %q twice", a)
+	}
+}
+
+func TestNames(t *testing.T) {
+	id := ID("vm-1")
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"BaseName", id.BaseName(), "base-vm-1"},
+		{"OverlayName", id.OverlayName(), "overlay-vm-1"},
+		{"OverlayFile", id.OverlayFile("/var/lib/x"), "/var/lib/x/image-vm-1.diff"},
+		{"ChrootDir", id.ChrootDir("/srv/jailer", "/usr/bin/firecracker"), "/srv/jailer/firecracker/vm-1"},
+		{"SocketPath", id.SocketPath("/srv/jailer", "/usr/bin/firecracker", "api.sock"), "/srv/jailer/firecracker/vm-1/root/api.sock"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestTapName(t *testing.T) {
+	long := ID(strings.Repeat("a", MaxLength))
+	if name := long.TapName(10); len(name) > 15 {
+		t.Errorf("TapName(10) = %q is longer than 15 characters", name)
+	}
+	if ID("vm-1").TapName(0) != ID("vm-1").TapName(0) {
+		t.Error("TapName is not stable")
+	}
+	if ID("vm-1").TapName(0) == ID("vm-2").TapName(0) {
+		t.Error("different VMs got the same tap")
+	}
+	if ID("vm-1").TapName(0) == ID("vm-1").TapName(1) {
+		t.Error("different NICs got the same tap")
+	}
+}